@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/services"
+	"codeberg.org/pennersr/shove/internal/services/apns"
+	"codeberg.org/pennersr/shove/internal/services/email"
+	"codeberg.org/pennersr/shove/internal/services/fcm"
+	"codeberg.org/pennersr/shove/internal/services/telegram"
+	"codeberg.org/pennersr/shove/internal/services/webhook"
+	"codeberg.org/pennersr/shove/internal/services/webpush"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the contents of the configuration file.
+type config struct {
+	Services []serviceConfig `yaml:"services"`
+}
+
+// serviceConfig declares an instance of a push service. Which of the
+// credentials apply depends on the type of the service.
+type serviceConfig struct {
+	Type string `yaml:"type"`
+	// ID identifies the instance, in the API as well as in the name of the
+	// queue. Defaults to the ID of the type (e.g. "apns-sandbox").
+	ID          string `yaml:"id"`
+	Workers     int    `yaml:"workers"`
+	MaxAttempts int    `yaml:"max_attempts"`
+	// RateAmount and RatePer configure squashing (Telegram and email only).
+	RateAmount int `yaml:"rate_amount"`
+	RatePer    int `yaml:"rate_per"`
+	// RateLimit caps the total number of pushes per second, and
+	// RateLimitBurst the number that can go out at once.
+	RateLimit      float64 `yaml:"rate_limit"`
+	RateLimitBurst int     `yaml:"rate_limit_burst"`
+
+	// APNS
+	Certificate string `yaml:"certificate"`
+	Sandbox     bool   `yaml:"sandbox"`
+	// FCM
+	CredentialsFile string `yaml:"credentials_file"`
+	// Telegram
+	BotToken string `yaml:"bot_token"`
+	// Web Push
+	VAPIDPublicKey  string `yaml:"vapid_public_key"`
+	VAPIDPrivateKey string `yaml:"vapid_private_key"`
+	// Email
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	TLS         bool   `yaml:"tls"`
+	TLSInsecure bool   `yaml:"tls_insecure"`
+	PlainAuth   bool   `yaml:"plain_auth"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+}
+
+// defaultWorkers is the number of workers per type of service, unless
+// configured otherwise.
+var defaultWorkers = map[string]int{
+	"apns":     4,
+	"email":    1,
+	"fcm":      4,
+	"telegram": 2,
+	"webhook":  2,
+	"webpush":  8,
+}
+
+// loadConfig reads the configuration file.
+func loadConfig(path string) (c config, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err = dec.Decode(&c); err != nil {
+		err = fmt.Errorf("%s: %w", path, err)
+		return
+	}
+	for i, sc := range c.Services {
+		if _, ok := defaultWorkers[sc.Type]; !ok {
+			err = fmt.Errorf("%s: service %d: unknown type %q", path, i+1, sc.Type)
+			return
+		}
+		if sc.RateAmount > 0 && sc.Type != "telegram" && sc.Type != "email" {
+			err = fmt.Errorf("%s: service %d: squashing is not supported by %s", path, i+1, sc.Type)
+			return
+		}
+		if sc.RateLimit < 0 || sc.RateLimitBurst < 0 {
+			err = fmt.Errorf("%s: service %d: rate limit cannot be negative", path, i+1)
+			return
+		}
+	}
+	return
+}
+
+// flagServices returns the services configured using the command line flags.
+func flagServices() (scs []serviceConfig) {
+	if *apnsCertificate != "" {
+		scs = append(scs, serviceConfig{
+			Type:        "apns",
+			Certificate: *apnsCertificate,
+			Workers:     *apnsWorkers,
+			MaxAttempts: *apnsMaxAttempts,
+		})
+	}
+	if *apnsSandboxCertificate != "" {
+		scs = append(scs, serviceConfig{
+			Type:        "apns",
+			Certificate: *apnsSandboxCertificate,
+			Sandbox:     true,
+			Workers:     *apnsWorkers,
+			MaxAttempts: *apnsMaxAttempts,
+		})
+	}
+	if *fcmCredentialsFile != "" {
+		scs = append(scs, serviceConfig{
+			Type:            "fcm",
+			CredentialsFile: *fcmCredentialsFile,
+			Workers:         *fcmWorkers,
+			MaxAttempts:     *fcmMaxAttempts,
+		})
+	}
+	if *webhookWorkers > 0 {
+		scs = append(scs, serviceConfig{
+			Type:        "webhook",
+			Workers:     *webhookWorkers,
+			MaxAttempts: *webhookMaxAttempts,
+		})
+	}
+	if *webPushVAPIDPrivateKey != "" {
+		scs = append(scs, serviceConfig{
+			Type:            "webpush",
+			VAPIDPublicKey:  *webPushVAPIDPublicKey,
+			VAPIDPrivateKey: *webPushVAPIDPrivateKey,
+			Workers:         *webPushWorkers,
+			MaxAttempts:     *webPushMaxAttempts,
+		})
+	}
+	if *telegramBotToken != "" {
+		scs = append(scs, serviceConfig{
+			Type:        "telegram",
+			BotToken:    *telegramBotToken,
+			Workers:     *telegramWorkers,
+			MaxAttempts: *telegramMaxAttempts,
+			RateAmount:  *telegramRateAmount,
+			RatePer:     *telegramRatePer,
+			RateLimit:   *telegramRateLimit,
+		})
+	}
+	if *emailHost != "" {
+		scs = append(scs, serviceConfig{
+			Type:        "email",
+			Host:        *emailHost,
+			Port:        *emailPort,
+			TLS:         *emailTLS,
+			TLSInsecure: *emailTLSInsecure,
+			PlainAuth:   *emailPlainAuth,
+			Username:    *emailUsername,
+			Password:    *emailPassword,
+			Workers:     1,
+			MaxAttempts: *emailMaxAttempts,
+			RateAmount:  *emailRateAmount,
+			RatePer:     *emailRatePer,
+			RateLimit:   *emailRateLimit,
+		})
+	}
+	return
+}
+
+// serviceID returns the ID of the service, as it will be set up.
+func (sc serviceConfig) serviceID() string {
+	if sc.ID != "" {
+		return sc.ID
+	}
+	if sc.Type == "apns" && sc.Sandbox {
+		return "apns-sandbox"
+	}
+	return sc.Type
+}
+
+// newService sets up the push service declared.
+func newService(sc serviceConfig, breaker services.BreakerConfig) (ps services.PushService, pc services.PumpConfig, err error) {
+	log := newServiceLogger(sc.serviceID())
+	switch sc.Type {
+	case "apns":
+		ps, err = apns.NewAPNSWithConfig(apns.Config{
+			ID:         sc.ID,
+			PEMFile:    sc.Certificate,
+			Production: !sc.Sandbox,
+		}, log)
+	case "fcm":
+		ps, err = fcm.NewFCMWithConfig(fcm.Config{
+			ID:              sc.ID,
+			CredentialsFile: sc.CredentialsFile,
+		}, log)
+	case "webhook":
+		ps, err = webhook.NewWebhookWithConfig(webhook.Config{
+			ID:    sc.ID,
+			Retry: sc.MaxAttempts > 0,
+		}, log)
+	case "webpush":
+		ps, err = webpush.NewWebPushWithConfig(webpush.Config{
+			ID:              sc.ID,
+			VAPIDPublicKey:  sc.VAPIDPublicKey,
+			VAPIDPrivateKey: sc.VAPIDPrivateKey,
+		}, log)
+	case "telegram":
+		ps, err = telegram.NewTelegramServiceWithConfig(telegram.Config{
+			ID:       sc.ID,
+			BotToken: sc.BotToken,
+		}, log)
+	case "email":
+		port := sc.Port
+		if port == 0 {
+			port = 25
+		}
+		ps, err = email.NewEmailService(email.EmailConfig{
+			ID:            sc.ID,
+			EmailHost:     sc.Host,
+			EmailPort:     port,
+			TLS:           sc.TLS,
+			TLSInsecure:   sc.TLSInsecure,
+			Log:           log,
+			PlainAuth:     sc.PlainAuth,
+			EmailUsername: sc.Username,
+			EmailPassword: sc.Password,
+		})
+	default:
+		err = fmt.Errorf("unknown service type %q", sc.Type)
+	}
+	if err != nil {
+		return
+	}
+	workers := sc.Workers
+	if workers <= 0 {
+		workers = defaultWorkers[sc.Type]
+	}
+	pc = services.PumpConfig{
+		Workers: workers,
+		Squash: services.SquashConfig{
+			RateMax: sc.RateAmount,
+			RatePer: time.Second * time.Duration(sc.RatePer),
+		},
+		MaxAttempts: sc.MaxAttempts,
+		Breaker:     breaker,
+		RateLimit: services.RateLimit{
+			Rate:  sc.RateLimit,
+			Burst: sc.RateLimitBurst,
+		},
+	}
+	return
+}
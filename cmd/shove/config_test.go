@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/services"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shove.yaml")
+	err := os.WriteFile(path, []byte(`
+services:
+  - type: telegram
+    id: telegram-support
+    bot_token: "123:abc"
+    rate_amount: 20
+    rate_per: 60
+    rate_limit: 30
+    rate_limit_burst: 5
+  - type: telegram
+    id: telegram-alerts
+    bot_token: "456:def"
+    workers: 1
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Services) != 2 {
+		t.Fatal(c.Services)
+	}
+	ps, pc, err := newService(c.Services[0], services.BreakerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.ID() != "telegram-support" || pc.Workers != 2 || pc.Squash.RateMax != 20 || pc.Squash.RatePer != time.Minute || pc.RateLimit.Rate != 30 || pc.RateLimit.Burst != 5 {
+		t.Fatal(ps.ID(), pc)
+	}
+	ps, pc, err = newService(c.Services[1], services.BreakerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.ID() != "telegram-alerts" || pc.Workers != 1 || pc.Squash.RateMax != 0 || pc.RateLimit.Rate != 0 {
+		t.Fatal(ps.ID(), pc)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, data := range []string{
+		"services:\n  - type: pigeon\n",
+		"services:\n  - type: fcm\n    rate_amount: 10\n",
+		"services:\n  - type: fcm\n    credentials: x\n",
+		"services:\n  - type: fcm\n    rate_limit: -1\n",
+	} {
+		path := filepath.Join(t.TempDir(), "shove.yaml")
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil {
+			t.Error(data)
+		}
+	}
+}
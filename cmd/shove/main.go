@@ -3,47 +3,70 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/queue/disk"
 	"codeberg.org/pennersr/shove/internal/queue/memory"
 	"codeberg.org/pennersr/shove/internal/queue/redis"
 	"codeberg.org/pennersr/shove/internal/server"
 	"codeberg.org/pennersr/shove/internal/services"
-	"codeberg.org/pennersr/shove/internal/services/apns"
-	"codeberg.org/pennersr/shove/internal/services/email"
-	"codeberg.org/pennersr/shove/internal/services/fcm"
-	"codeberg.org/pennersr/shove/internal/services/telegram"
 	"codeberg.org/pennersr/shove/internal/services/webhook"
-	"codeberg.org/pennersr/shove/internal/services/webpush"
 	"golang.org/x/exp/slog"
 )
 
 var debug = flag.Bool("debug", false, "Enable debug logging")
+var configFile = flag.String("config", "", "Path to the configuration file declaring the services (YAML)")
 var apiAddr = flag.String("api-addr", ":8322", "API address to listen to")
+var idempotencyWindow = flag.Int("idempotency-window", 0, "The period (in seconds) within which pushes with the same idempotency key are rejected, 0 disables deduplication")
+var breakerThreshold = flag.Int("breaker-threshold", 0, "The number of consecutive temporary failures after which pushing to a service is suspended (0 to disable)")
+var breakerCooldown = flag.Int("breaker-cooldown", 30, "The period (in seconds) pushing to a service is suspended before probing whether it is back up")
+var shutdownTimeout = flag.Int("shutdown-timeout", 30, "The period (in seconds) given to finish pushing when shutting down, or when a service is removed or replaced on reload")
+var statusRetention = flag.Int("status-retention", 0, "The period (in seconds) for which message statuses are retained (0 to disable)")
+var apiKeysFile = flag.String("api-keys-file", "", "Path to the file holding the API keys (also read from $SHOVE_API_KEYS)")
+var feedbackExpired = flag.Bool("feedback-expired", false, "Report tokens of expired messages as feedback")
+var feedbackCallbackURL = flag.String("feedback-callback-url", "", "URL to post feedback to")
+var feedbackCallbackServiceURLs = flag.String("feedback-callback-service-urls", "", "URLs to post feedback to per service, overriding -feedback-callback-url (e.g. apns=https://...,fcm=https://...)")
+var feedbackCallbackSecret = flag.String("feedback-callback-secret", "", "Secret used to sign feedback callbacks")
+var feedbackCallbackMaxAttempts = flag.Int("feedback-callback-max-attempts", 10, "The max. number of attempts to post a feedback callback (0 for unlimited)")
+
+var tracingEndpoint = flag.String("tracing-otlp-endpoint", "", "Export traces to this OTLP/HTTP endpoint (e.g. localhost:4318)")
+var tracingInsecure = flag.Bool("tracing-otlp-insecure", false, "Export traces over plain HTTP instead of HTTPS")
+var tracingSampleRatio = flag.Float64("tracing-sample-ratio", 1, "The ratio of traces sampled, unless the producer already decided")
 
 var apnsCertificate = flag.String("apns-certificate-path", "", "APNS certificate path")
 var apnsSandboxCertificate = flag.String("apns-sandbox-certificate-path", "", "APNS sandbox certificate path")
 var apnsWorkers = flag.Int("apns-workers", 4, "The number of workers pushing APNS messages")
+var apnsMaxAttempts = flag.Int("apns-max-attempts", 0, "The max. number of attempts to push an APNS message (0 for unlimited)")
 
 var fcmCredentialsFile = flag.String("fcm-credentials-file", "", "FCM credentials file")
 var fcmWorkers = flag.Int("fcm-workers", 4, "The number of workers pushing FCM messages")
+var fcmMaxAttempts = flag.Int("fcm-max-attempts", 0, "The max. number of attempts to push an FCM message (0 for unlimited)")
 
 var redisURL = flag.String("queue-redis", "", "Use Redis queue (Redis URL)")
+var queueDir = flag.String("queue-dir", "", "Use disk queue (directory path)")
+var queueCapacity = flag.Int("queue-memory-capacity", 0, "The max. number of messages per in-memory queue (0 for unlimited)")
+var queueSnapshotDir = flag.String("queue-memory-snapshot-dir", "", "Save the in-memory queues to this directory when shutting down, restoring them on startup")
 
 var webhookWorkers = flag.Int("webhook-workers", 0, "The number of workers pushing Webhook messages")
+var webhookMaxAttempts = flag.Int("webhook-max-attempts", 0, "The max. number of attempts to push a Webhook message (0 for unlimited)")
 
 var webPushVAPIDPublicKey = flag.String("webpush-vapid-public-key", "", "VAPID public key")
 var webPushVAPIDPrivateKey = flag.String("webpush-vapid-private-key", "", "VAPID public key")
 var webPushWorkers = flag.Int("webpush-workers", 8, "The number of workers pushing Web messages")
+var webPushMaxAttempts = flag.Int("webpush-max-attempts", 0, "The max. number of attempts to push a Web message (0 for unlimited)")
 
 var telegramBotToken = flag.String("telegram-bot-token", "", "Telegram bot token")
 var telegramWorkers = flag.Int("telegram-workers", 2, "The number of workers pushing Telegram messages")
+var telegramMaxAttempts = flag.Int("telegram-max-attempts", 0, "The max. number of attempts to push a Telegram message (0 for unlimited)")
 var telegramRateAmount = flag.Int("telegram-rate-amount", 0, "Telegram max. rate (amount)")
 var telegramRatePer = flag.Int("telegram-rate-per", 0, "Telegram max. rate (per seconds)")
+var telegramRateLimit = flag.Float64("telegram-rate-limit", 0, "The max. number of Telegram messages pushed per second, across all chats (0 for unlimited)")
 
 var emailHost = flag.String("email-host", "", "Email host")
 var emailPort = flag.Int("email-port", 25, "Email port")
@@ -54,6 +77,8 @@ var emailTLS = flag.Bool("email-tls", false, "Use TLS")
 var emailTLSInsecure = flag.Bool("email-tls-insecure", false, "Skip TLS verification")
 var emailRateAmount = flag.Int("email-rate-amount", 0, "Email max. rate (amount)")
 var emailRatePer = flag.Int("email-rate-per", 0, "Email max. rate (per seconds)")
+var emailRateLimit = flag.Float64("email-rate-limit", 0, "The max. number of emails sent per second, across all recipients (0 for unlimited)")
+var emailMaxAttempts = flag.Int("email-max-attempts", 0, "The max. number of attempts to send an email (0 for unlimited)")
 
 func newLogger() *slog.Logger {
 	var opts *slog.HandlerOptions
@@ -73,6 +98,41 @@ func newServiceLogger(service string) *slog.Logger {
 	)
 }
 
+// loadAPIKeys reads the API keys from the file passed, as well as from the
+// environment, using the same format (keys may be separated by ";" as well).
+func loadAPIKeys() (keys []server.APIKey, err error) {
+	if *apiKeysFile != "" {
+		if keys, err = server.LoadAPIKeys(*apiKeysFile); err != nil {
+			return
+		}
+	}
+	if env := os.Getenv("SHOVE_API_KEYS"); env != "" {
+		var envKeys []server.APIKey
+		if envKeys, err = server.ParseAPIKeys(strings.NewReader(strings.ReplaceAll(env, ";", "\n"))); err != nil {
+			return
+		}
+		keys = append(keys, envKeys...)
+	}
+	return
+}
+
+// parseServiceURLs parses a comma separated list of service=url pairs.
+func parseServiceURLs(s string) (urls map[string]string, err error) {
+	urls = make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		service, url, ok := strings.Cut(pair, "=")
+		if !ok || service == "" || url == "" {
+			err = fmt.Errorf("expected service=url, got %q", pair)
+			return
+		}
+		urls[service] = url
+	}
+	return
+}
+
 func main() {
 	flag.Parse()
 
@@ -82,112 +142,102 @@ func main() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		slog.Error("Failed to setup tracing", "error", err)
+		os.Exit(1)
+	}
+
 	var qf queue.QueueFactory
-	if *redisURL == "" {
-		slog.Info("Using non-persistent in-memory queue")
-		qf = memory.MemoryQueueFactory{}
-	} else {
+	if *redisURL != "" && *queueDir != "" {
+		slog.Error("Redis and disk queues are mutually exclusive")
+		os.Exit(1)
+	}
+	if *redisURL != "" {
 		slog.Info("Using Redis queue at", "address", *redisURL)
 		qf = redis.NewQueueFactory(*redisURL)
-	}
-	s := server.NewServer(*apiAddr, qf)
-
-	if *apnsCertificate != "" {
-		apns, err := apns.NewAPNS(*apnsCertificate, true, newServiceLogger("apns"))
-		if err != nil {
-			slog.Error("Failed to setup APNS service", "error", err)
-			os.Exit(1)
-		}
-		if err := s.AddService(apns, *apnsWorkers, services.SquashConfig{}); err != nil {
-			slog.Error("Failed to add APNS service", "error", err)
-			os.Exit(1)
+	} else if *queueDir != "" {
+		slog.Info("Using disk queue at", "directory", *queueDir)
+		qf = disk.NewQueueFactory(*queueDir)
+	} else {
+		if *queueSnapshotDir != "" {
+			slog.Info("Using in-memory queue, saved on shutdown to", "directory", *queueSnapshotDir)
+		} else {
+			slog.Info("Using non-persistent in-memory queue")
 		}
+		qf = memory.MemoryQueueFactory{Capacity: *queueCapacity, SnapshotDir: *queueSnapshotDir}
 	}
-
-	if *apnsSandboxCertificate != "" {
-		apns, err := apns.NewAPNS(*apnsSandboxCertificate, false, newServiceLogger("apns-sandbox"))
-		if err != nil {
-			slog.Error("Failed to setup APNS sandbox service", "error", err)
-			os.Exit(1)
-		}
-		if err := s.AddService(apns, *apnsWorkers, services.SquashConfig{}); err != nil {
-			slog.Error("Failed to add APNS sandbox service", "error", err)
-			os.Exit(1)
-		}
+	apiKeys, err := loadAPIKeys()
+	if err != nil {
+		slog.Error("Failed to load API keys", "error", err)
+		os.Exit(1)
 	}
-
-	if *fcmCredentialsFile != "" {
-		fcm, err := fcm.NewFCM(*fcmCredentialsFile, newServiceLogger("fcm"))
-		if err != nil {
-			slog.Error("Failed to setup FCM service", "error", err)
-			os.Exit(1)
-		}
-		if err := s.AddService(fcm, *fcmWorkers, services.SquashConfig{}); err != nil {
-			slog.Error("Failed to add FCM service", "error", err)
-			os.Exit(1)
-		}
+	if len(apiKeys) == 0 {
+		slog.Warn("No API keys configured, the API is open to anyone")
+	}
+	s, err := server.NewServer(*apiAddr, qf, server.Config{
+		ExpiredFeedback:   *feedbackExpired,
+		IdempotencyWindow: time.Second * time.Duration(*idempotencyWindow),
+		StatusRetention:   time.Second * time.Duration(*statusRetention),
+		APIKeys:           apiKeys,
+		DrainTimeout:      time.Second * time.Duration(*shutdownTimeout),
+	})
+	if err != nil {
+		slog.Error("Failed to setup server", "error", err)
+		os.Exit(1)
 	}
 
-	if *webhookWorkers > 0 {
-		wh, err := webhook.NewWebhook(newServiceLogger("webhook"))
-		if err != nil {
-			slog.Error("Failed to setup Webhook service", "error", err)
-			os.Exit(1)
-		}
-		if err := s.AddService(wh, *webhookWorkers, services.SquashConfig{}); err != nil {
-			slog.Error("Failed to add Webhook service", "error", err)
-			os.Exit(1)
-		}
+	breaker := services.BreakerConfig{
+		Threshold: *breakerThreshold,
+		Cooldown:  time.Second * time.Duration(*breakerCooldown),
 	}
 
-	if *webPushVAPIDPrivateKey != "" {
-		web, err := webpush.NewWebPush(*webPushVAPIDPublicKey, *webPushVAPIDPrivateKey, newServiceLogger("webpush"))
+	r := newReloader(s, breaker)
+	if err := r.reload(); err != nil {
+		slog.Error("Failed to setup services", "error", err)
+		os.Exit(1)
+	}
+	reload := func() error {
+		slog.Info("Reloading configuration")
+		err := r.reload()
 		if err != nil {
-			slog.Error("Failed to setup WebPush service", "error", err)
-			os.Exit(1)
-		}
-		if err := s.AddService(web, *webPushWorkers, services.SquashConfig{}); err != nil {
-			slog.Error("Failed to add WebPush service", "error", err)
-			os.Exit(1)
+			slog.Error("Failed to reload configuration", "error", err)
 		}
+		return err
 	}
+	s.SetReloader(reload)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload()
+		}
+	}()
 
-	if *telegramBotToken != "" {
-		tg, err := telegram.NewTelegramService(*telegramBotToken, newServiceLogger("telegram"))
+	if *feedbackCallbackURL != "" || *feedbackCallbackServiceURLs != "" {
+		serviceURLs, err := parseServiceURLs(*feedbackCallbackServiceURLs)
 		if err != nil {
-			slog.Error("Failed to setup Telegram service", "error", err)
-			os.Exit(1)
-		}
-		if err := s.AddService(tg, *telegramWorkers, services.SquashConfig{
-			RateMax: *telegramRateAmount,
-			RatePer: time.Second * time.Duration(*telegramRatePer),
-		}); err != nil {
-			slog.Error("Failed to add Telegram service", "error", err)
+			slog.Error("Invalid feedback callback URLs", "error", err)
 			os.Exit(1)
 		}
-	}
-
-	if *emailHost != "" {
-		config := email.EmailConfig{
-			EmailHost:     *emailHost,
-			EmailPort:     *emailPort,
-			TLS:           *emailTLS,
-			TLSInsecure:   *emailTLSInsecure,
-			Log:           newServiceLogger("email"),
-			PlainAuth:     *emailPlainAuth,
-			EmailUsername: *emailUsername,
-			EmailPassword: *emailPassword,
-		}
-		email, err := email.NewEmailService(config)
+		wh, err := webhook.NewWebhookWithConfig(webhook.Config{
+			ID:    "feedback-callback",
+			Retry: *feedbackCallbackMaxAttempts > 0,
+		}, newServiceLogger("feedback-callback"))
 		if err != nil {
-			slog.Error("Failed to setup email service", "error", err)
+			slog.Error("Failed to setup feedback callback service", "error", err)
 			os.Exit(1)
 		}
-		if err := s.AddService(email, 1, services.SquashConfig{
-			RateMax: *emailRateAmount,
-			RatePer: time.Second * time.Duration(*emailRatePer),
+		if err := s.SetFeedbackCallback(wh, server.FeedbackCallbackConfig{
+			URL:         *feedbackCallbackURL,
+			ServiceURLs: serviceURLs,
+			Secret:      *feedbackCallbackSecret,
+		}, services.PumpConfig{
+			Workers:     2,
+			MaxAttempts: *feedbackCallbackMaxAttempts,
+			Breaker:     breaker,
 		}); err != nil {
-			slog.Error("Failed to add email service", "error", err)
+			slog.Error("Failed to add feedback callback service", "error", err)
 			os.Exit(1)
 		}
 	}
@@ -201,8 +251,17 @@ func main() {
 		}
 	}()
 	<-stop
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	slog.Info("Draining", "timeout", *shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(*shutdownTimeout))
 	defer cancel()
-	s.Shutdown(ctx)
+	if err := s.Shutdown(ctx); err != nil {
+		slog.Error("Failed to shut down cleanly", "error", err)
+	}
+	// The traces of the drain itself are flushed as well.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
 	slog.Info("Exiting")
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"codeberg.org/pennersr/shove/internal/server"
+	"codeberg.org/pennersr/shove/internal/services"
+)
+
+// loadedService is a service as it was set up, used to tell whether or not it
+// changed since.
+type loadedService struct {
+	config serviceConfig
+	// fingerprint covers the contents of the credential files, so that
+	// rotated certificates are picked up.
+	fingerprint string
+}
+
+// reloader reconciles the services of the server with the configuration.
+type reloader struct {
+	lock     sync.Mutex
+	server   *server.Server
+	breaker  services.BreakerConfig
+	services map[string]loadedService
+}
+
+func newReloader(s *server.Server, breaker services.BreakerConfig) *reloader {
+	return &reloader{
+		server:   s,
+		breaker:  breaker,
+		services: make(map[string]loadedService),
+	}
+}
+
+// serviceConfigs returns the services configured, using flags as well as the
+// configuration file.
+func serviceConfigs() (scs []serviceConfig, err error) {
+	scs = flagServices()
+	if *configFile != "" {
+		var c config
+		if c, err = loadConfig(*configFile); err != nil {
+			return
+		}
+		scs = append(scs, c.Services...)
+	}
+	seen := make(map[string]bool)
+	for _, sc := range scs {
+		if seen[sc.serviceID()] {
+			err = fmt.Errorf("duplicate service ID %q", sc.serviceID())
+			return
+		}
+		seen[sc.serviceID()] = true
+	}
+	return
+}
+
+// fingerprint hashes the credential files of the service.
+func fingerprint(sc serviceConfig) (string, error) {
+	h := sha256.New()
+	for _, path := range []string{sc.Certificate, sc.CredentialsFile} {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// reload adds the services that were added to the configuration, removes the
+// ones that were removed, and replaces the ones that changed. Services that
+// are left untouched keep pushing. In case the configuration cannot be
+// loaded, nothing changes. A service that fails to be set up is reported,
+// without affecting the others.
+func (r *reloader) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	scs, err := serviceConfigs()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	configured := make(map[string]bool)
+	for _, sc := range scs {
+		id := sc.serviceID()
+		configured[id] = true
+		fp, err := fingerprint(sc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		loaded := loadedService{config: sc, fingerprint: fp}
+		current, exists := r.services[id]
+		if exists && current == loaded {
+			continue
+		}
+		ps, pc, err := newService(sc, r.breaker)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		if exists {
+			err = r.server.ReplaceService(ps, pc)
+		} else {
+			err = r.server.AddService(ps, pc)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		r.services[id] = loaded
+	}
+	for id := range r.services {
+		if configured[id] {
+			continue
+		}
+		if err := r.server.RemoveService(id); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		delete(r.services, id)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+
+	"codeberg.org/pennersr/shove/internal/services"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/exp/slog"
+)
+
+// setupTracing sets up the propagation of trace contexts and, if an endpoint
+// is configured, the export of spans over OTLP. The returned function flushes
+// the pending spans.
+func setupTracing() (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	shutdown = func(context.Context) error { return nil }
+	if *tracingEndpoint == "" {
+		return
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(*tracingEndpoint)}
+	if *tracingInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "shove"),
+	))
+	if err != nil {
+		return
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*tracingSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Exporting traces", "endpoint", *tracingEndpoint, "tracer", services.TracerName)
+	shutdown = provider.Shutdown
+	return
+}
@@ -0,0 +1,206 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+)
+
+// feedbackFile is the name of the feedback log, followed by the consumer (if
+// any) and the segment suffix.
+const feedbackFile = "feedback"
+
+// diskFeedbackStore keeps the feedback entries in a log of its own. The
+// entries not acknowledged yet are kept in memory as well.
+type diskFeedbackStore struct {
+	path    string
+	lock    sync.Mutex
+	log     *os.File
+	logSize int64
+	// liveSize is the size of the entries not acknowledged yet.
+	liveSize int64
+	entries  []record
+	acked    uint64
+	nextSeq  uint64
+}
+
+func (dqf *diskQueueFactory) NewFeedbackStore(consumer string) (fs queue.FeedbackStore, err error) {
+	if err = os.MkdirAll(dqf.dir, 0o700); err != nil {
+		return
+	}
+	name := feedbackFile
+	if consumer != "" {
+		name += "-" + consumer
+	}
+	dfs := &diskFeedbackStore{
+		path:    filepath.Join(dqf.dir, name+segmentSuffix),
+		nextSeq: 1,
+	}
+	if _, err = os.Stat(dfs.path); err == nil {
+		var valid int64
+		if valid, err = replaySegment(dfs.path, true, dfs.apply); err != nil {
+			return
+		}
+		if err = os.Truncate(dfs.path, valid); err != nil {
+			return
+		}
+		dfs.logSize = valid
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	dfs.log, err = os.OpenFile(dfs.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	fs = dfs
+	return
+}
+
+func (dfs *diskFeedbackStore) apply(r record) {
+	switch r.op {
+	case opFeedback:
+		if r.id > dfs.acked {
+			dfs.entries = append(dfs.entries, r)
+			dfs.liveSize += r.size()
+		}
+	case opAck:
+		dfs.discard(r.id)
+	}
+	if r.id >= dfs.nextSeq {
+		dfs.nextSeq = r.id + 1
+	}
+}
+
+// discard forgets about the entries up to and including the sequence number.
+func (dfs *diskFeedbackStore) discard(seq uint64) {
+	if seq <= dfs.acked {
+		return
+	}
+	dfs.acked = seq
+	n := 0
+	for n < len(dfs.entries) && dfs.entries[n].id <= seq {
+		dfs.liveSize -= dfs.entries[n].size()
+		n++
+	}
+	dfs.entries = append([]record(nil), dfs.entries[n:]...)
+}
+
+func (dfs *diskFeedbackStore) append(r record) (err error) {
+	if _, err = dfs.log.Write(r.encode()); err != nil {
+		return
+	}
+	if err = dfs.log.Sync(); err != nil {
+		return
+	}
+	dfs.logSize += r.size()
+	return
+}
+
+func (dfs *diskFeedbackStore) Append(data []byte) (id string, err error) {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	r := record{op: opFeedback, id: dfs.nextSeq, msg: data}
+	if err = dfs.append(r); err != nil {
+		return
+	}
+	dfs.nextSeq++
+	dfs.entries = append(dfs.entries, r)
+	dfs.liveSize += r.size()
+	id = strconv.FormatUint(r.id, 10)
+	return
+}
+
+func (dfs *diskFeedbackStore) Read(cursor string, count int) (entries []queue.FeedbackEntry, err error) {
+	seq, err := memory.ParseCursor(cursor)
+	if err != nil {
+		return
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	for _, r := range dfs.entries {
+		if len(entries) >= count {
+			break
+		}
+		if r.id <= seq {
+			continue
+		}
+		entries = append(entries, queue.FeedbackEntry{
+			ID:   strconv.FormatUint(r.id, 10),
+			Data: r.msg,
+		})
+	}
+	return
+}
+
+func (dfs *diskFeedbackStore) Last() (string, error) {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if len(dfs.entries) == 0 {
+		return "", nil
+	}
+	return strconv.FormatUint(dfs.entries[len(dfs.entries)-1].id, 10), nil
+}
+
+func (dfs *diskFeedbackStore) Ack(cursor string) (err error) {
+	seq, err := memory.ParseCursor(cursor)
+	if err != nil {
+		return
+	}
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	if seq <= dfs.acked {
+		return
+	}
+	if seq >= dfs.nextSeq {
+		seq = dfs.nextSeq - 1
+	}
+	if err = dfs.append(record{op: opAck, id: seq}); err != nil {
+		return
+	}
+	dfs.discard(seq)
+	if dfs.logSize >= compactThreshold && dfs.logSize >= 2*dfs.liveSize {
+		err = dfs.compact()
+	}
+	return
+}
+
+// compact rewrites the log, holding only the entries not acknowledged yet. The
+// acknowledgement is retained, so that IDs are not reused.
+func (dfs *diskFeedbackStore) compact() (err error) {
+	tmp := dfs.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return
+	}
+	ack := record{op: opAck, id: dfs.acked}
+	buf := ack.encode()
+	for _, r := range dfs.entries {
+		buf = append(buf, r.encode()...)
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, dfs.path); err != nil {
+		return
+	}
+	log, err := os.OpenFile(dfs.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	dfs.log.Close()
+	dfs.log = log
+	dfs.logSize = int64(len(buf))
+	return
+}
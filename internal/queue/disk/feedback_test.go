@@ -0,0 +1,77 @@
+package disk
+
+import (
+	"testing"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+)
+
+func newFeedbackStore(t *testing.T, dir string) queue.FeedbackStore {
+	fs, err := NewQueueFactory(dir).NewFeedbackStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func readIDs(t *testing.T, fs queue.FeedbackStore, cursor string) (ids []string) {
+	entries, err := fs.Read(cursor, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return
+}
+
+func TestFeedbackRecover(t *testing.T) {
+	dir := t.TempDir()
+	fs := newFeedbackStore(t, dir)
+	for _, data := range []string{"a", "b", "c"} {
+		if _, err := fs.Append([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := readIDs(t, fs, "1"); len(ids) != 2 || ids[0] != "2" {
+		t.Fatal(ids)
+	}
+	if err := fs.Ack("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = newFeedbackStore(t, dir)
+	if ids := readIDs(t, fs, ""); len(ids) != 2 || ids[0] != "2" || ids[1] != "3" {
+		t.Fatal(ids)
+	}
+	if _, err := fs.Read("bogus", 10); err != queue.ErrInvalidCursor {
+		t.Fatal(err)
+	}
+}
+
+func TestFeedbackCompact(t *testing.T) {
+	defer func(threshold int64) {
+		compactThreshold = threshold
+	}(compactThreshold)
+	compactThreshold = 1
+
+	dir := t.TempDir()
+	fs := newFeedbackStore(t, dir)
+	fs.Append([]byte("a"))
+	fs.Append([]byte("b"))
+	if err := fs.Ack("2"); err != nil {
+		t.Fatal(err)
+	}
+	// IDs are not reused after everything is acknowledged and compacted.
+	fs = newFeedbackStore(t, dir)
+	id, err := fs.Append([]byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "3" {
+		t.Fatal(id)
+	}
+	if ids := readIDs(t, fs, ""); len(ids) != 1 || ids[0] != "3" {
+		t.Fatal(ids)
+	}
+}
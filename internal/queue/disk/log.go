@@ -0,0 +1,151 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type op byte
+
+const (
+	// opQueue adds a message, or overwrites its state when replaying a
+	// compacted segment.
+	opQueue op = iota + 1
+	opRemove
+	opRequeue
+	opPostpone
+	opDead
+	// opFeedback adds a feedback entry, opAck acknowledges all entries up to
+	// and including the ID.
+	opFeedback
+	opAck
+)
+
+// record is the unit written to the log. Each record is encoded as:
+//
+//	op (1) | id (8) | attempts (4) | due (8) | length (4) | msg | crc32 (4)
+type record struct {
+	op       op
+	id       uint64
+	attempts uint32
+	// due is the time (in Unix milliseconds) before which the message is
+	// not to be handed out, zero meaning immediately.
+	due int64
+	msg []byte
+}
+
+const recordHeaderSize = 1 + 8 + 4 + 8 + 4
+
+const segmentSuffix = ".log"
+
+var errCorrupt = errors.New("corrupt record")
+
+func (r record) size() int64 {
+	return int64(recordHeaderSize + len(r.msg) + 4)
+}
+
+func (r record) encode() []byte {
+	buf := make([]byte, r.size())
+	buf[0] = byte(r.op)
+	binary.BigEndian.PutUint64(buf[1:], r.id)
+	binary.BigEndian.PutUint32(buf[9:], r.attempts)
+	binary.BigEndian.PutUint64(buf[13:], uint64(r.due))
+	binary.BigEndian.PutUint32(buf[21:], uint32(len(r.msg)))
+	copy(buf[recordHeaderSize:], r.msg)
+	n := recordHeaderSize + len(r.msg)
+	binary.BigEndian.PutUint32(buf[n:], crc32.ChecksumIEEE(buf[:n]))
+	return buf
+}
+
+func readRecord(rd io.Reader) (r record, err error) {
+	var header [recordHeaderSize]byte
+	if _, err = io.ReadFull(rd, header[:]); err != nil {
+		return
+	}
+	r.op = op(header[0])
+	r.id = binary.BigEndian.Uint64(header[1:])
+	r.attempts = binary.BigEndian.Uint32(header[9:])
+	r.due = int64(binary.BigEndian.Uint64(header[13:]))
+	length := binary.BigEndian.Uint32(header[21:])
+	rest := make([]byte, int(length)+4)
+	if _, err = io.ReadFull(rd, rest); err != nil {
+		return
+	}
+	r.msg = rest[:length]
+	crc := crc32.NewIEEE()
+	crc.Write(header[:])
+	crc.Write(r.msg)
+	if crc.Sum32() != binary.BigEndian.Uint32(rest[length:]) {
+		err = errCorrupt
+	}
+	return
+}
+
+// replaySegment reads all records from a segment, and returns the offset up
+// to which the segment is valid. A torn write at the end of the last segment
+// is not considered to be an error, but a corrupt or short record anywhere
+// else is, as the records following it would be lost.
+func replaySegment(path string, last bool, apply func(record)) (valid int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	for {
+		var r record
+		r, err = readRecord(rd)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err == io.ErrUnexpectedEOF || err == errCorrupt {
+			if _, peekErr := rd.Peek(1); last && peekErr == io.EOF {
+				err = nil
+			} else {
+				err = fmt.Errorf("%s: %w at offset %d", path, errCorrupt, valid)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		apply(r)
+		valid += r.size()
+	}
+}
+
+func segmentPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", seq, segmentSuffix))
+}
+
+// listSegments returns the sequence numbers of the segments in the
+// directory, in ascending order.
+func listSegments(dir string) (seqs []int, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return
+}
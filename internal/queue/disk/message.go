@@ -0,0 +1,33 @@
+package disk
+
+import (
+	"time"
+)
+
+type diskQueuedMessage struct {
+	id       uint64
+	msg      []byte
+	attempts int
+	due      time.Time
+}
+
+func (qm *diskQueuedMessage) Message() []byte {
+	return qm.msg
+}
+
+func (qm *diskQueuedMessage) Attempts() int {
+	return qm.attempts
+}
+
+func (qm *diskQueuedMessage) record(op op) record {
+	r := record{
+		op:       op,
+		id:       qm.id,
+		attempts: uint32(qm.attempts),
+		msg:      qm.msg,
+	}
+	if !qm.due.IsZero() {
+		r.due = qm.due.UnixMilli()
+	}
+	return r
+}
@@ -0,0 +1,415 @@
+package disk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+	"codeberg.org/pennersr/shove/internal/queue/schedule"
+	"golang.org/x/exp/slog"
+)
+
+// The active segment is compacted once it exceeds this size, and holds more
+// than twice the amount of live data.
+var compactThreshold int64 = 4 * 1024 * 1024
+
+const deadLetterFile = "dead" + segmentSuffix
+
+type diskQueueFactory struct {
+	dir string
+}
+
+type diskQueue struct {
+	dir         string
+	messages    map[uint64]*diskQueuedMessage
+	waiting     *schedule.Queue[*diskQueuedMessage]
+	nextID      uint64
+	segment     *os.File
+	segmentSeq  int
+	segmentSize int64
+	liveSize    int64
+	dead        *os.File
+	deadCount   int
+	lock        sync.Mutex
+}
+
+// NewQueueFactory returns a factory for queues that are persisted in the given
+// directory, one subdirectory per queue.
+func NewQueueFactory(dir string) queue.QueueFactory {
+	return &diskQueueFactory{dir: dir}
+}
+
+func (dqf *diskQueueFactory) NewQueue(id string) (q queue.Queue, err error) {
+	dir := filepath.Join(dqf.dir, id)
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return
+	}
+	dq := &diskQueue{
+		dir:      dir,
+		messages: make(map[uint64]*diskQueuedMessage),
+		nextID:   1,
+	}
+	dq.waiting = schedule.New[*diskQueuedMessage](&dq.lock)
+	if err = dq.recover(); err != nil {
+		return
+	}
+	deadPath := filepath.Join(dir, deadLetterFile)
+	if _, err = os.Stat(deadPath); err == nil {
+		_, err = replaySegment(deadPath, true, func(record) {
+			dq.deadCount++
+		})
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		dq.segment.Close()
+		return
+	}
+	dq.dead, err = os.OpenFile(deadPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		dq.segment.Close()
+		return
+	}
+	q = dq
+	return
+}
+
+// recover replays the segments, and considers all messages that were in
+// flight at the time of a crash as ready to be handed out again.
+func (dq *diskQueue) recover() (err error) {
+	seqs, err := listSegments(dq.dir)
+	if err != nil {
+		return
+	}
+	var valid int64
+	for i, seq := range seqs {
+		path := segmentPath(dq.dir, seq)
+		if valid, err = replaySegment(path, i == len(seqs)-1, dq.apply); err != nil {
+			return
+		}
+		if i < len(seqs)-1 {
+			continue
+		}
+		// The last segment is the one we continue to append to, cut off
+		// any trailing torn write.
+		if err = os.Truncate(path, valid); err != nil {
+			return
+		}
+		dq.segmentSeq = seq
+	}
+	if dq.segmentSeq == 0 {
+		dq.segmentSeq = 1
+	}
+	dq.segment, err = os.OpenFile(segmentPath(dq.dir, dq.segmentSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	dq.segmentSize = valid
+
+	now := time.Now()
+	for _, qm := range dq.sortedMessages() {
+		dq.liveSize += qm.record(opQueue).size()
+		if qm.due.After(now) {
+			dq.waiting.Schedule(qm, qm.due)
+		} else {
+			qm.due = time.Time{}
+			dq.waiting.Push(qm)
+		}
+		if qm.id >= dq.nextID {
+			dq.nextID = qm.id + 1
+		}
+	}
+	if len(dq.messages) > 0 {
+		slog.Info("Recovered queued messages", "queue", filepath.Base(dq.dir), "count", len(dq.messages))
+	}
+	return
+}
+
+func (dq *diskQueue) apply(r record) {
+	switch r.op {
+	case opQueue:
+		dq.messages[r.id] = &diskQueuedMessage{
+			id:       r.id,
+			msg:      r.msg,
+			attempts: int(r.attempts),
+			due:      dueTime(r.due),
+		}
+	case opRemove, opDead:
+		delete(dq.messages, r.id)
+	case opRequeue:
+		if qm, ok := dq.messages[r.id]; ok {
+			qm.attempts++
+			qm.due = time.Time{}
+		}
+	case opPostpone:
+		if qm, ok := dq.messages[r.id]; ok {
+			qm.due = dueTime(r.due)
+		}
+	}
+	if r.id >= dq.nextID {
+		dq.nextID = r.id + 1
+	}
+}
+
+func dueTime(due int64) time.Time {
+	if due == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(due)
+}
+
+func (dq *diskQueue) sortedMessages() []*diskQueuedMessage {
+	qms := make([]*diskQueuedMessage, 0, len(dq.messages))
+	for _, qm := range dq.messages {
+		qms = append(qms, qm)
+	}
+	sort.Slice(qms, func(i, j int) bool {
+		return qms[i].id < qms[j].id
+	})
+	return qms
+}
+
+// append durably writes the record to the active segment.
+func (dq *diskQueue) append(r record) (err error) {
+	if _, err = dq.segment.Write(r.encode()); err != nil {
+		return
+	}
+	if err = dq.segment.Sync(); err != nil {
+		return
+	}
+	dq.segmentSize += r.size()
+	return
+}
+
+// maybeCompact rewrites the live messages into a fresh segment once the active
+// segment is mostly made up of garbage.
+func (dq *diskQueue) maybeCompact() {
+	if dq.segmentSize < compactThreshold || dq.segmentSize < 2*dq.liveSize {
+		return
+	}
+	if err := dq.compact(); err != nil {
+		slog.Error("Unable to compact queue", "queue", filepath.Base(dq.dir), "error", err)
+	}
+}
+
+func (dq *diskQueue) compact() (err error) {
+	seq := dq.segmentSeq + 1
+	path := segmentPath(dq.dir, seq)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return
+	}
+	var size int64
+	for _, qm := range dq.sortedMessages() {
+		r := qm.record(opQueue)
+		if _, err = f.Write(r.encode()); err != nil {
+			f.Close()
+			return
+		}
+		size += r.size()
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return
+	}
+	segment, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	dq.segment.Close()
+	for s := dq.segmentSeq; s > 0; s-- {
+		if err := os.Remove(segmentPath(dq.dir, s)); err != nil {
+			break
+		}
+	}
+	dq.segment = segment
+	dq.segmentSeq = seq
+	dq.segmentSize = size
+	dq.liveSize = size
+	return nil
+}
+
+func (dq *diskQueue) Queue(msg []byte) (err error) {
+	return dq.queue(msg, time.Time{})
+}
+
+func (dq *diskQueue) QueueAt(msg []byte, due time.Time) (err error) {
+	return dq.queue(msg, due)
+}
+
+func (dq *diskQueue) queue(msg []byte, due time.Time) (err error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	qm := &diskQueuedMessage{
+		id:  dq.nextID,
+		msg: msg,
+		due: due,
+	}
+	r := qm.record(opQueue)
+	if err = dq.append(r); err != nil {
+		return
+	}
+	dq.nextID++
+	dq.liveSize += r.size()
+	dq.messages[qm.id] = qm
+	if due.IsZero() {
+		dq.waiting.Push(qm)
+	} else {
+		dq.waiting.Schedule(qm, due)
+	}
+	return
+}
+
+// QueueBatch appends all messages to the log using a single write, paying
+// for only one sync.
+func (dq *diskQueue) QueueBatch(msgs [][]byte) (err error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	qms := make([]*diskQueuedMessage, len(msgs))
+	var buf []byte
+	for i, msg := range msgs {
+		qms[i] = &diskQueuedMessage{
+			id:  dq.nextID + uint64(i),
+			msg: msg,
+		}
+		buf = append(buf, qms[i].record(opQueue).encode()...)
+	}
+	if _, err = dq.segment.Write(buf); err != nil {
+		return
+	}
+	if err = dq.segment.Sync(); err != nil {
+		return
+	}
+	size := int64(len(buf))
+	dq.segmentSize += size
+	dq.liveSize += size
+	dq.nextID += uint64(len(msgs))
+	for _, qm := range qms {
+		dq.messages[qm.id] = qm
+		dq.waiting.Push(qm)
+	}
+	return
+}
+
+func (dq *diskQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	qm, err := dq.waiting.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Scheduled messages are due by now.
+	qm.due = time.Time{}
+	return qm, nil
+}
+
+func (dq *diskQueue) Remove(qm queue.QueuedMessage) (err error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	dqm := qm.(*diskQueuedMessage)
+	if err = dq.append(record{op: opRemove, id: dqm.id}); err != nil {
+		return
+	}
+	dq.forget(dqm)
+	dq.maybeCompact()
+	return
+}
+
+func (dq *diskQueue) forget(qm *diskQueuedMessage) {
+	delete(dq.messages, qm.id)
+	dq.liveSize -= qm.record(opQueue).size()
+}
+
+func (dq *diskQueue) Requeue(qm queue.QueuedMessage) (err error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	dqm := qm.(*diskQueuedMessage)
+	if err = dq.append(record{op: opRequeue, id: dqm.id}); err != nil {
+		return
+	}
+	dqm.attempts++
+	dq.waiting.Push(dqm)
+	return
+}
+
+func (dq *diskQueue) Postpone(qm queue.QueuedMessage, due time.Time) (err error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	dqm := qm.(*diskQueuedMessage)
+	if err = dq.append(record{op: opPostpone, id: dqm.id, due: due.UnixMilli()}); err != nil {
+		return
+	}
+	dqm.due = due
+	dq.waiting.Schedule(dqm, due)
+	return
+}
+
+func (dq *diskQueue) Dead(qm queue.QueuedMessage) (err error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	dqm := qm.(*diskQueuedMessage)
+	dead := dqm.record(opDead)
+	if _, err = dq.dead.Write(dead.encode()); err != nil {
+		return
+	}
+	if err = dq.dead.Sync(); err != nil {
+		return
+	}
+	dq.deadCount++
+	if err = dq.append(record{op: opDead, id: dqm.id}); err != nil {
+		return
+	}
+	dq.forget(dqm)
+	dq.maybeCompact()
+	return
+}
+
+func (dq *diskQueue) Depth() (queue.Depth, error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	return queue.Depth{
+		Waiting:   dq.waiting.Ready(),
+		InFlight:  len(dq.messages) - dq.waiting.Ready() - dq.waiting.Scheduled(),
+		Scheduled: dq.waiting.Scheduled(),
+		Dead:      dq.deadCount,
+	}, nil
+}
+
+// Shutdown stops handing out messages. The log is kept open, so that the
+// messages still in flight can be removed or requeued.
+func (dq *diskQueue) Shutdown() (err error) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	dq.waiting.Shutdown()
+	return
+}
+
+// NewDeduplicator returns an in-memory deduplicator, as idempotency keys are
+// only relevant for a short window.
+func (dqf *diskQueueFactory) NewDeduplicator(id string) (queue.Deduplicator, error) {
+	return memory.NewDeduplicator(), nil
+}
+
+// NewSquashStore returns an in-memory squash store. Squashed messages remain
+// in flight in the disk queue, so that they are pushed again after a restart.
+func (dqf *diskQueueFactory) NewSquashStore(id string) (queue.SquashStore, error) {
+	return memory.NewSquashStore(), nil
+}
+
+// NewStatusStore returns an in-memory status store, as statuses are only
+// retained for a limited period.
+func (dqf *diskQueueFactory) NewStatusStore() (queue.StatusStore, error) {
+	return memory.NewStatusStore(), nil
+}
@@ -0,0 +1,139 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, dq *diskQueue) *diskQueuedMessage {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qm, err := dq.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qm.(*diskQueuedMessage)
+}
+
+func newQueue(t *testing.T, dir string) *diskQueue {
+	q, err := NewQueueFactory(dir).NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q.(*diskQueue)
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	dq := newQueue(t, dir)
+	for _, msg := range []string{"removed", "in-flight", "requeued", "dead", "scheduled"} {
+		if err := dq.Queue([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dq.Remove(get(t, dq))
+	get(t, dq)
+	dq.Requeue(get(t, dq))
+	dq.Dead(get(t, dq))
+	dq.Postpone(get(t, dq), time.Now().Add(time.Hour))
+
+	// Simulate a crash by reopening the queue without shutting down.
+	dq = newQueue(t, dir)
+	if dq.waiting.Scheduled() != 1 {
+		t.Fatal(dq.waiting.Scheduled())
+	}
+	qm := get(t, dq)
+	if string(qm.Message()) != "in-flight" {
+		t.Fatal(string(qm.Message()))
+	}
+	qm = get(t, dq)
+	if string(qm.Message()) != "requeued" || qm.Attempts() != 1 {
+		t.Fatal(string(qm.Message()), qm.Attempts())
+	}
+	if dq.waiting.Ready() != 0 {
+		t.Fatal(dq.waiting.Ready())
+	}
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	dq := newQueue(t, dir)
+	dq.Queue([]byte("hello"))
+	dq.Queue([]byte("world"))
+	path := segmentPath(dq.dir, dq.segmentSeq)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	dq = newQueue(t, dir)
+	if len(dq.messages) != 1 {
+		t.Fatal(len(dq.messages))
+	}
+	dq.Queue([]byte("again"))
+	dq = newQueue(t, dir)
+	if len(dq.messages) != 2 {
+		t.Fatal(len(dq.messages))
+	}
+}
+
+func TestRecoverCorruption(t *testing.T) {
+	dir := t.TempDir()
+	dq := newQueue(t, dir)
+	dq.Queue([]byte("hello"))
+	dq.Queue([]byte("world"))
+	path := segmentPath(dq.dir, dq.segmentSeq)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unlike a torn write, a corrupt record followed by others is not
+	// silently dropped along with them.
+	data[recordHeaderSize] ^= 0xff
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewQueueFactory(dir).NewQueue("test"); !errors.Is(err, errCorrupt) {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	defer func(threshold int64) {
+		compactThreshold = threshold
+	}(compactThreshold)
+	compactThreshold = 4096
+
+	dir := t.TempDir()
+	dq := newQueue(t, dir)
+	dq.Queue([]byte("keep"))
+	keep := get(t, dq)
+	for i := 0; i < 200; i++ {
+		dq.Queue([]byte(fmt.Sprintf("message-%d", i)))
+		dq.Remove(get(t, dq))
+	}
+	if dq.segmentSeq == 1 {
+		t.Fatal("not compacted")
+	}
+	segments, err := listSegments(dq.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatal(segments)
+	}
+	dq.Requeue(keep)
+
+	dq = newQueue(t, dir)
+	qm := get(t, dq)
+	if string(qm.Message()) != "keep" || qm.Attempts() != 1 {
+		t.Fatal(string(qm.Message()), qm.Attempts())
+	}
+}
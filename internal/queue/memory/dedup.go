@@ -0,0 +1,56 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+)
+
+// sweepInterval is the interval at which expired keys are dropped.
+const sweepInterval = time.Minute
+
+type deduplicator struct {
+	lock      sync.Mutex
+	expiries  map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewDeduplicator returns a deduplicator keeping track of idempotency keys in
+// memory.
+func NewDeduplicator() queue.Deduplicator {
+	return &deduplicator{
+		expiries:  make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func (d *deduplicator) Claim(key string, window time.Duration) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	if now.Sub(d.lastSweep) > sweepInterval {
+		d.sweep(now)
+	}
+	if expiry, ok := d.expiries[key]; ok && expiry.After(now) {
+		return false, nil
+	}
+	d.expiries[key] = now.Add(window)
+	return true, nil
+}
+
+func (d *deduplicator) Release(key string) error {
+	d.lock.Lock()
+	delete(d.expiries, key)
+	d.lock.Unlock()
+	return nil
+}
+
+func (d *deduplicator) sweep(now time.Time) {
+	for key, expiry := range d.expiries {
+		if !expiry.After(now) {
+			delete(d.expiries, key)
+		}
+	}
+	d.lastSweep = now
+}
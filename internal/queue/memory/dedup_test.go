@@ -0,0 +1,27 @@
+package memory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator()
+	if claimed, _ := d.Claim("a", time.Hour); !claimed {
+		t.Fatal("not claimed")
+	}
+	if claimed, _ := d.Claim("a", time.Hour); claimed {
+		t.Fatal("claimed twice")
+	}
+	if claimed, _ := d.Claim("b", time.Millisecond); !claimed {
+		t.Fatal("not claimed")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if claimed, _ := d.Claim("b", time.Hour); !claimed {
+		t.Fatal("window not honoured")
+	}
+	d.Release("a")
+	if claimed, _ := d.Claim("a", time.Hour); !claimed {
+		t.Fatal("not released")
+	}
+}
@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+)
+
+type feedbackEntry struct {
+	seq  uint64
+	data []byte
+}
+
+type feedbackStore struct {
+	lock    sync.Mutex
+	entries []feedbackEntry
+	nextSeq uint64
+}
+
+// NewFeedbackStore returns a feedback store keeping the entries in memory.
+func NewFeedbackStore() queue.FeedbackStore {
+	return &feedbackStore{nextSeq: 1}
+}
+
+// ParseCursor parses cursors of stores that use sequence numbers as IDs, an
+// empty cursor being sequence number zero.
+func ParseCursor(cursor string) (seq uint64, err error) {
+	if cursor == "" {
+		return
+	}
+	seq, err = strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		err = queue.ErrInvalidCursor
+	}
+	return
+}
+
+func (fs *feedbackStore) Append(data []byte) (string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	seq := fs.nextSeq
+	fs.nextSeq++
+	fs.entries = append(fs.entries, feedbackEntry{seq: seq, data: data})
+	return strconv.FormatUint(seq, 10), nil
+}
+
+// after returns the index of the first entry following the sequence number.
+func (fs *feedbackStore) after(seq uint64) int {
+	return sort.Search(len(fs.entries), func(i int) bool {
+		return fs.entries[i].seq > seq
+	})
+}
+
+func (fs *feedbackStore) Read(cursor string, count int) (entries []queue.FeedbackEntry, err error) {
+	seq, err := ParseCursor(cursor)
+	if err != nil {
+		return
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, e := range fs.entries[fs.after(seq):] {
+		if len(entries) >= count {
+			break
+		}
+		entries = append(entries, queue.FeedbackEntry{
+			ID:   strconv.FormatUint(e.seq, 10),
+			Data: e.data,
+		})
+	}
+	return
+}
+
+func (fs *feedbackStore) Last() (string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if len(fs.entries) == 0 {
+		return "", nil
+	}
+	return strconv.FormatUint(fs.entries[len(fs.entries)-1].seq, 10), nil
+}
+
+func (fs *feedbackStore) Ack(cursor string) (err error) {
+	seq, err := ParseCursor(cursor)
+	if err != nil {
+		return
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n := fs.after(seq)
+	fs.entries = append([]feedbackEntry(nil), fs.entries[n:]...)
+	return
+}
@@ -1,11 +1,14 @@
 package memory
 
 type memoryQueuedMessage struct {
-	msg     []byte
-	pending bool
-	idx     int
+	msg      []byte
+	attempts int
 }
 
 func (qm *memoryQueuedMessage) Message() []byte {
 	return qm.msg
 }
+
+func (qm *memoryQueuedMessage) Attempts() int {
+	return qm.attempts
+}
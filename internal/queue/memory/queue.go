@@ -2,55 +2,99 @@ package memory
 
 import (
 	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/queue/schedule"
 	"context"
-	"errors"
+	"golang.org/x/exp/slog"
 	"sync"
+	"time"
 )
 
 // MemoryQueueFactory ...
-type MemoryQueueFactory struct{}
+type MemoryQueueFactory struct {
+	// Capacity limits the number of messages a queue can hold, zero meaning
+	// unlimited.
+	Capacity int
+	// SnapshotDir, if set, is the directory the queues are saved to when
+	// shutting down, and restored from when created.
+	SnapshotDir string
+}
+
+// deadCapacity is the number of messages kept on the dead-letter queue, which
+// cannot be consumed. Beyond that, the oldest messages are dropped.
+const deadCapacity = 1000
 
 type memoryQueue struct {
-	buf          []*memoryQueuedMessage
+	// waiting holds the messages waiting to be handed out.
+	waiting *schedule.Queue[*memoryQueuedMessage]
+	// inFlight holds the messages that have been handed out, but are not
+	// yet removed or requeued.
+	inFlight     map[*memoryQueuedMessage]struct{}
+	dead         [][]byte
+	deadCapacity int
+	// deadDropped counts the dead messages dropped as the dead-letter queue
+	// was full.
+	deadDropped  int
+	capacity     int
 	lock         sync.Mutex
-	cond         *sync.Cond
-	shuttingDown bool
+	snapshotPath string
+}
+
+func (mq *memoryQueue) size() int {
+	return mq.waiting.Ready() + len(mq.inFlight) + mq.waiting.Scheduled()
+}
+
+func (mq *memoryQueue) full() bool {
+	return mq.capacity > 0 && mq.size() >= mq.capacity
 }
 
 func (mq *memoryQueue) Queue(msg []byte) (err error) {
 	mq.lock.Lock()
-	qm := &memoryQueuedMessage{
-		msg: msg,
-		idx: -1,
+	defer mq.lock.Unlock()
+	if mq.full() {
+		return queue.ErrFull
 	}
-	for i := 0; i < len(mq.buf); i++ {
-		if mq.buf[i] == nil {
-			qm.idx = i
-			mq.buf[i] = qm
-			break
-		}
+	mq.waiting.Push(&memoryQueuedMessage{msg: msg})
+	return nil
+}
+
+func (mq *memoryQueue) QueueBatch(msgs [][]byte) (err error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	if mq.capacity > 0 && mq.size()+len(msgs) > mq.capacity {
+		return queue.ErrFull
 	}
-	if qm.idx < 0 {
-		qm.idx = len(mq.buf)
-		mq.buf = append(mq.buf, qm)
+	for _, msg := range msgs {
+		mq.waiting.Push(&memoryQueuedMessage{msg: msg})
 	}
-	mq.lock.Unlock()
-	mq.cond.Signal()
+	return nil
+}
+
+func (mq *memoryQueue) QueueAt(msg []byte, due time.Time) (err error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	if mq.full() {
+		return queue.ErrFull
+	}
+	mq.waiting.Schedule(&memoryQueuedMessage{msg: msg}, due)
 	return nil
 }
 
 func (mq *memoryQueue) Shutdown() (err error) {
 	mq.lock.Lock()
-	mq.shuttingDown = true
-	mq.cond.Broadcast()
-	mq.lock.Unlock()
+	defer mq.lock.Unlock()
+	if mq.waiting.ShuttingDown() {
+		return
+	}
+	mq.waiting.Shutdown()
+	if mq.snapshotPath != "" {
+		err = mq.save()
+	}
 	return
 }
 
 func (mq *memoryQueue) Remove(qm queue.QueuedMessage) (err error) {
 	mq.lock.Lock()
-	mqm := qm.(*memoryQueuedMessage)
-	mq.buf[mqm.idx] = nil
+	delete(mq.inFlight, qm.(*memoryQueuedMessage))
 	mq.lock.Unlock()
 	return nil
 }
@@ -58,44 +102,98 @@ func (mq *memoryQueue) Remove(qm queue.QueuedMessage) (err error) {
 func (mq *memoryQueue) Requeue(qm queue.QueuedMessage) (err error) {
 	mq.lock.Lock()
 	mqm := qm.(*memoryQueuedMessage)
-	mqm.pending = false
+	delete(mq.inFlight, mqm)
+	mqm.attempts++
+	mq.waiting.Push(mqm)
 	mq.lock.Unlock()
-	mq.cond.Signal()
 	return
 }
 
-func (mq *memoryQueue) getNextMessage() *memoryQueuedMessage {
-	for i := 0; i < len(mq.buf); i++ {
-		m := mq.buf[i]
-		if m != nil && !m.pending {
-			m.pending = true
-			return m
-		}
-	}
+func (mq *memoryQueue) Postpone(qm queue.QueuedMessage, due time.Time) (err error) {
+	mq.lock.Lock()
+	mqm := qm.(*memoryQueuedMessage)
+	delete(mq.inFlight, mqm)
+	mq.waiting.Schedule(mqm, due)
+	mq.lock.Unlock()
 	return nil
 }
 
+func (mq *memoryQueue) Dead(qm queue.QueuedMessage) (err error) {
+	mq.lock.Lock()
+	mqm := qm.(*memoryQueuedMessage)
+	delete(mq.inFlight, mqm)
+	mq.park(mqm.msg)
+	mq.lock.Unlock()
+	return nil
+}
+
+// park adds the messages to the dead-letter queue, dropping the oldest ones
+// once it is full.
+func (mq *memoryQueue) park(msgs ...[]byte) {
+	mq.dead = append(mq.dead, msgs...)
+	if excess := len(mq.dead) - mq.deadCapacity; excess > 0 {
+		mq.dead = mq.dead[excess:]
+		mq.deadDropped += excess
+		slog.Warn("Dead-letter queue full, dropping oldest messages", "dropped_count", mq.deadDropped)
+	}
+}
+
+func (mq *memoryQueue) Depth() (queue.Depth, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	return queue.Depth{
+		Waiting:   mq.waiting.Ready(),
+		InFlight:  len(mq.inFlight),
+		Scheduled: mq.waiting.Scheduled(),
+		Dead:      len(mq.dead),
+	}, nil
+}
+
 func (mq *memoryQueue) Get(ctx context.Context) (queue.QueuedMessage, error) {
-	mq.cond.L.Lock()
-	defer mq.cond.L.Unlock()
-	for ctx.Err() == nil {
-		if mq.shuttingDown {
-			break
-		}
-		msg := mq.getNextMessage()
-		if msg == nil {
-			mq.cond.Wait()
-			continue
-		}
-		return msg, nil
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	msg, err := mq.waiting.Get(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("queue shut down")
+	mq.inFlight[msg] = struct{}{}
+	return msg, nil
 }
 
 // NewQueue ...
 func (mqf MemoryQueueFactory) NewQueue(id string) (q queue.Queue, err error) {
-	mq := &memoryQueue{}
-	mq.cond = sync.NewCond(&mq.lock)
+	mq := &memoryQueue{
+		inFlight:     make(map[*memoryQueuedMessage]struct{}),
+		capacity:     mqf.Capacity,
+		deadCapacity: deadCapacity,
+	}
+	mq.waiting = schedule.New[*memoryQueuedMessage](&mq.lock)
+	if mqf.SnapshotDir != "" {
+		mq.snapshotPath = snapshotPath(mqf.SnapshotDir, id)
+		if err = mq.restore(); err != nil {
+			return
+		}
+	}
 	q = mq
 	return
 }
+
+// NewDeduplicator ...
+func (mqf MemoryQueueFactory) NewDeduplicator(id string) (queue.Deduplicator, error) {
+	return NewDeduplicator(), nil
+}
+
+// NewStatusStore ...
+func (mqf MemoryQueueFactory) NewStatusStore() (queue.StatusStore, error) {
+	return NewStatusStore(), nil
+}
+
+// NewSquashStore ...
+func (mqf MemoryQueueFactory) NewSquashStore(id string) (queue.SquashStore, error) {
+	return NewSquashStore(), nil
+}
+
+// NewFeedbackStore ...
+func (mqf MemoryQueueFactory) NewFeedbackStore(consumer string) (queue.FeedbackStore, error) {
+	return NewFeedbackStore(), nil
+}
@@ -0,0 +1,71 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+)
+
+// benchmarkBurst queues a burst of messages, and then consumes all of them.
+func benchmarkBurst(b *testing.B, size int) {
+	msg := []byte(`{"token": "abc"}`)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		q, _ := MemoryQueueFactory{}.NewQueue("bench")
+		for j := 0; j < size; j++ {
+			q.Queue(msg)
+		}
+		for j := 0; j < size; j++ {
+			qm, err := q.Get(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			q.Remove(qm)
+		}
+	}
+}
+
+// benchmarkInFlight keeps a window of messages in flight while cycling
+// through a backlog, as a set of workers would.
+func benchmarkInFlight(b *testing.B, backlog int) {
+	const inFlight = 1000
+	msg := []byte(`{"token": "abc"}`)
+	ctx := context.Background()
+	q, _ := MemoryQueueFactory{}.NewQueue("bench")
+	for j := 0; j < backlog; j++ {
+		q.Queue(msg)
+	}
+	window := make([]queue.QueuedMessage, 0, inFlight)
+	for j := 0; j < inFlight; j++ {
+		qm, _ := q.Get(ctx)
+		window = append(window, qm)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Remove(window[i%inFlight])
+		q.Queue(msg)
+		qm, err := q.Get(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		window[i%inFlight] = qm
+	}
+}
+
+func BenchmarkBurst(b *testing.B) {
+	for _, size := range []int{1000, 10000, 50000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			benchmarkBurst(b, size)
+		})
+	}
+}
+
+func BenchmarkInFlight(b *testing.B) {
+	for _, backlog := range []int{10000, 100000} {
+		b.Run(fmt.Sprint(backlog), func(b *testing.B) {
+			benchmarkInFlight(b, backlog)
+		})
+	}
+}
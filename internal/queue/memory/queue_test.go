@@ -0,0 +1,240 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+)
+
+func TestRequeueCountsAttempts(t *testing.T) {
+	q, err := MemoryQueueFactory{}.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Queue([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		qm, err := q.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if qm.Attempts() != i {
+			t.Fatal(qm.Attempts())
+		}
+		if err = q.Requeue(qm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDead(t *testing.T) {
+	q, err := MemoryQueueFactory{}.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Queue([]byte("poison"))
+	q.Queue([]byte("ok"))
+	qm, err := q.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Dead(qm); err != nil {
+		t.Fatal(err)
+	}
+	mq := q.(*memoryQueue)
+	if len(mq.dead) != 1 || string(mq.dead[0]) != "poison" {
+		t.Fatal(mq.dead)
+	}
+	qm, err = q.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(qm.Message()) != "ok" {
+		t.Fatal(string(qm.Message()))
+	}
+	// Once full, the oldest dead messages are dropped.
+	mq.deadCapacity = 1
+	if err = q.Dead(qm); err != nil {
+		t.Fatal(err)
+	}
+	if len(mq.dead) != 1 || string(mq.dead[0]) != "ok" || mq.deadDropped != 1 {
+		t.Fatal(mq.dead, mq.deadDropped)
+	}
+}
+
+func TestQueueAt(t *testing.T) {
+	q, err := MemoryQueueFactory{}.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.QueueAt([]byte("later"), time.Now().Add(50*time.Millisecond))
+	q.QueueAt([]byte("soon"), time.Now().Add(10*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, expected := range []string{"soon", "later"} {
+		qm, err := q.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(qm.Message()) != expected {
+			t.Fatal(string(qm.Message()))
+		}
+		q.Remove(qm)
+	}
+}
+
+func TestPostpone(t *testing.T) {
+	q, err := MemoryQueueFactory{}.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Queue([]byte("hello"))
+	ctx := context.Background()
+	qm, err := q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Requeue(qm)
+	qm, err = q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	due := time.Now().Add(20 * time.Millisecond)
+	q.Postpone(qm, due)
+	qm, err = q.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Before(due) {
+		t.Fatal("handed out before due")
+	}
+	if qm.Attempts() != 1 {
+		t.Fatal(qm.Attempts())
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	q, err := MemoryQueueFactory{Capacity: 2}.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Queue([]byte("1"))
+	q.QueueAt([]byte("2"), time.Now().Add(time.Hour))
+	if err = q.Queue([]byte("3")); err != queue.ErrFull {
+		t.Fatal(err)
+	}
+	qm, err := q.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In flight messages still count.
+	if err = q.Queue([]byte("3")); err != queue.ErrFull {
+		t.Fatal(err)
+	}
+	q.Remove(qm)
+	if err = q.Queue([]byte("3")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueBatch(t *testing.T) {
+	q, err := MemoryQueueFactory{Capacity: 3}.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Queue([]byte("1"))
+	// The batch does not fit, so nothing is queued.
+	if err = q.QueueBatch([][]byte{[]byte("2"), []byte("3"), []byte("4")}); err != queue.ErrFull {
+		t.Fatal(err)
+	}
+	if err = q.QueueBatch([][]byte{[]byte("2"), []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		qm, err := q.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(qm.Message()) != want {
+			t.Fatal(string(qm.Message()))
+		}
+		q.Remove(qm)
+	}
+}
+
+func TestGetCancel(t *testing.T) {
+	q, err := MemoryQueueFactory{}.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = q.Get(ctx); err == nil {
+		t.Fatal("got a message from an empty queue")
+	}
+	// The queue remains usable by other consumers.
+	if err = q.Queue([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	qm, err := q.Get(context.Background())
+	if err != nil || string(qm.Message()) != "hello" {
+		t.Fatal(qm, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	qf := MemoryQueueFactory{SnapshotDir: t.TempDir()}
+	q, err := qf.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Queue([]byte("a"))
+	q.Queue([]byte("b"))
+	q.QueueAt([]byte("scheduled"), time.Now().Add(time.Hour))
+	qm, err := q.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Requeue(qm); err != nil {
+		t.Fatal(err)
+	}
+	if qm, err = q.Get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = qf.NewQueue("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	depth, _ := q.Depth()
+	if depth.Waiting != 2 || depth.Scheduled != 1 {
+		t.Fatal(depth)
+	}
+	// The message in flight ("b") comes first, attempt counts are kept.
+	for _, expected := range []string{"b", "a"} {
+		qm, err := q.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(qm.Message()) != expected {
+			t.Fatal(string(qm.Message()))
+		}
+		if expected == "a" && qm.Attempts() != 1 {
+			t.Fatal(qm.Attempts())
+		}
+	}
+	// Restored only once.
+	if q, err = qf.NewQueue("test"); err != nil {
+		t.Fatal(err)
+	}
+	if depth, _ = q.Depth(); depth.Waiting != 0 {
+		t.Fatal(depth)
+	}
+}
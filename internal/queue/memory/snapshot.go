@@ -0,0 +1,81 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshot is the contents of a queue, as persisted when shutting down.
+type snapshot struct {
+	Messages []snapshotMessage `json:"messages"`
+	Dead     [][]byte          `json:"dead,omitempty"`
+}
+
+type snapshotMessage struct {
+	Message  []byte     `json:"message"`
+	Attempts int        `json:"attempts,omitempty"`
+	Due      *time.Time `json:"due,omitempty"`
+}
+
+func snapshotPath(dir, id string) string {
+	return filepath.Join(dir, id+".json")
+}
+
+// save writes the messages to the snapshot file. Messages in flight are saved
+// as waiting, so that they are pushed again.
+func (mq *memoryQueue) save() (err error) {
+	var s snapshot
+	for qm := range mq.inFlight {
+		s.Messages = append(s.Messages, snapshotMessage{Message: qm.msg, Attempts: qm.attempts})
+	}
+	mq.waiting.Each(func(qm *memoryQueuedMessage, due time.Time) {
+		sm := snapshotMessage{Message: qm.msg, Attempts: qm.attempts}
+		if !due.IsZero() {
+			sm.Due = &due
+		}
+		s.Messages = append(s.Messages, sm)
+	})
+	s.Dead = mq.dead
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	// Write and rename, so that a crash halfway does not leave a truncated
+	// snapshot behind.
+	tmp := mq.snapshotPath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return
+	}
+	return os.Rename(tmp, mq.snapshotPath)
+}
+
+// restore loads the messages from the snapshot file, if any. The file is
+// removed afterwards, so that the messages are not restored twice in case of
+// a crash.
+func (mq *memoryQueue) restore() (err error) {
+	data, err := os.ReadFile(mq.snapshotPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	var s snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+	for _, sm := range s.Messages {
+		qm := &memoryQueuedMessage{msg: sm.Message, attempts: sm.Attempts}
+		if sm.Due != nil {
+			mq.waiting.Schedule(qm, *sm.Due)
+		} else {
+			mq.waiting.Push(qm)
+		}
+	}
+	mq.park(s.Dead...)
+	return os.Remove(mq.snapshotPath)
+}
@@ -0,0 +1,189 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+)
+
+// squashedMessage is a message that remains in flight in its queue while
+// squashed.
+type squashedMessage struct {
+	q  queue.Queue
+	qm queue.QueuedMessage
+}
+
+type pendingBatch struct {
+	msgs     []squashedMessage
+	due      time.Time
+	failures int
+}
+
+type squashStore struct {
+	lock      sync.Mutex
+	pushedAt  map[string][]time.Time
+	batches   map[string]*pendingBatch
+	lastSweep time.Time
+}
+
+// NewSquashStore returns a squash store keeping track of the rates and batches
+// in memory. Squashed messages are left in flight in their queue until the
+// batch is done with.
+func NewSquashStore() queue.SquashStore {
+	return &squashStore{
+		pushedAt:  make(map[string][]time.Time),
+		batches:   make(map[string]*pendingBatch),
+		lastSweep: time.Now(),
+	}
+}
+
+// sweep drops the keys that were not pushed to within the period, as keys
+// that are not pushed to again (e.g. one-off email recipients) would otherwise
+// be kept forever. Sweeping at most once per period keeps the cost in line
+// with the number of pushes.
+func (ss *squashStore) sweep(per time.Duration, now time.Time) {
+	if now.Sub(ss.lastSweep) < min(per, sweepInterval) {
+		return
+	}
+	for key, times := range ss.pushedAt {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) > per {
+			delete(ss.pushedAt, key)
+		}
+	}
+	ss.lastSweep = now
+}
+
+// TrackedKeys returns the number of squash keys of which pushes are kept
+// track of.
+func (ss *squashStore) TrackedKeys() int {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return len(ss.pushedAt)
+}
+
+// window drops the pushes to the key that fell out of the period, returning
+// the ones that remain.
+func (ss *squashStore) window(key string, per time.Duration, now time.Time) []time.Time {
+	times := ss.pushedAt[key]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > per {
+		i++
+	}
+	if i > 0 {
+		times = times[i:]
+		ss.pushedAt[key] = times
+	}
+	return times
+}
+
+func (ss *squashStore) Acquire(key string, max int, per time.Duration) (acquired bool, freeAt time.Time, err error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	now := time.Now()
+	ss.sweep(per, now)
+	times := ss.window(key, per, now)
+	if len(times) < max {
+		ss.pushedAt[key] = append(times, now)
+		acquired = true
+		return
+	}
+	freeAt = times[0].Add(per)
+	return
+}
+
+func (ss *squashStore) Record(key string, per time.Duration) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	now := time.Now()
+	ss.sweep(per, now)
+	ss.pushedAt[key] = append(ss.window(key, per, now), now)
+	return nil
+}
+
+func (ss *squashStore) Squash(q queue.Queue, qm queue.QueuedMessage, key string, due time.Time) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	b, ok := ss.batches[key]
+	if !ok {
+		b = &pendingBatch{due: due}
+		ss.batches[key] = b
+	}
+	b.msgs = append(b.msgs, squashedMessage{q: q, qm: qm})
+	return nil
+}
+
+func (ss *squashStore) Take(by time.Time) (b *queue.SquashedBatch, next time.Time, err error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	var first *pendingBatch
+	var firstKey string
+	for key, pb := range ss.batches {
+		if first == nil || pb.due.Before(first.due) {
+			first = pb
+			firstKey = key
+		}
+	}
+	if first == nil {
+		return
+	}
+	if first.due.After(by) {
+		next = first.due
+		return
+	}
+	// Taken off, messages squashed from now on start a new batch.
+	delete(ss.batches, firstKey)
+	b = &queue.SquashedBatch{
+		Key:      firstKey,
+		Messages: make([][]byte, len(first.msgs)),
+		Failures: first.failures,
+		Handle:   first.msgs,
+	}
+	for i, sm := range first.msgs {
+		b.Messages[i] = sm.qm.Message()
+	}
+	return
+}
+
+func (ss *squashStore) Done(b *queue.SquashedBatch, next time.Time) (err error) {
+	for _, sm := range b.Handle.([]squashedMessage) {
+		if e := sm.q.Remove(sm.qm); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (ss *squashStore) Dead(b *queue.SquashedBatch, next time.Time) (err error) {
+	for _, sm := range b.Handle.([]squashedMessage) {
+		if e := sm.q.Dead(sm.qm); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (ss *squashStore) Retry(b *queue.SquashedBatch, due time.Time) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	msgs := b.Handle.([]squashedMessage)
+	if pending, ok := ss.batches[b.Key]; ok {
+		// Messages squashed in the meantime go along with the batch.
+		msgs = append(msgs, pending.msgs...)
+		if pending.due.After(due) {
+			due = pending.due
+		}
+	}
+	ss.batches[b.Key] = &pendingBatch{msgs: msgs, due: due, failures: b.Failures}
+	return nil
+}
+
+func (ss *squashStore) Pending() (int, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return len(ss.batches), nil
+}
+
+func (ss *squashStore) Persistent() bool {
+	return false
+}
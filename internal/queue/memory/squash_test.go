@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSquashStore(t *testing.T) {
+	ss := NewSquashStore()
+	if acquired, _, _ := ss.Acquire("a", 1, time.Hour); !acquired {
+		t.Fatal("not acquired")
+	}
+	acquired, freeAt, _ := ss.Acquire("a", 1, time.Hour)
+	if acquired || time.Until(freeAt) < 59*time.Minute {
+		t.Fatal(acquired, freeAt)
+	}
+
+	q, _ := MemoryQueueFactory{}.NewQueue("test")
+	q.Queue([]byte("1"))
+	q.Queue([]byte("2"))
+	for i := 0; i < 2; i++ {
+		qm, _ := q.Get(context.Background())
+		ss.Squash(q, qm, "a", freeAt)
+	}
+	if b, next, _ := ss.Take(time.Now()); b != nil || !next.Equal(freeAt) {
+		t.Fatal(b, next)
+	}
+	b, _, _ := ss.Take(freeAt)
+	if b == nil || len(b.Messages) != 2 {
+		t.Fatal(b)
+	}
+	if pending, _ := ss.Pending(); pending != 0 {
+		t.Fatal(pending)
+	}
+	b.Failures++
+	ss.Retry(b, time.Now())
+	if b, _, _ = ss.Take(time.Now()); b == nil || b.Failures != 1 {
+		t.Fatal(b)
+	}
+	ss.Done(b, time.Now())
+	depth, _ := q.Depth()
+	if depth.InFlight != 0 {
+		t.Fatal(depth)
+	}
+}
+
+func TestSquashStoreBounded(t *testing.T) {
+	ss := NewSquashStore().(*squashStore)
+	tracked := 0
+	for i := 0; i < 2000000; i++ {
+		// Every recipient is a key of its own.
+		ss.Acquire(strconv.Itoa(i), 1, 10*time.Millisecond)
+		if i%10000 == 0 {
+			tracked = max(tracked, ss.TrackedKeys())
+		}
+	}
+	if tracked > 200000 {
+		t.Fatal(tracked)
+	}
+	time.Sleep(20 * time.Millisecond)
+	ss.Acquire("last", 1, 10*time.Millisecond)
+	if n := ss.TrackedKeys(); n != 1 {
+		t.Fatal(n)
+	}
+}
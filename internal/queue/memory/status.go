@@ -0,0 +1,58 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+)
+
+type storedStatus struct {
+	status []byte
+	expiry time.Time
+}
+
+type statusStore struct {
+	lock      sync.Mutex
+	statuses  map[string]storedStatus
+	lastSweep time.Time
+}
+
+// NewStatusStore returns a status store keeping track of message statuses in
+// memory.
+func NewStatusStore() queue.StatusStore {
+	return &statusStore{
+		statuses:  make(map[string]storedStatus),
+		lastSweep: time.Now(),
+	}
+}
+
+func (ss *statusStore) SetStatus(id string, status []byte, retention time.Duration) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	now := time.Now()
+	if now.Sub(ss.lastSweep) > sweepInterval {
+		ss.sweep(now)
+	}
+	ss.statuses[id] = storedStatus{status: status, expiry: now.Add(retention)}
+	return nil
+}
+
+func (ss *statusStore) GetStatus(id string) ([]byte, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	stored, ok := ss.statuses[id]
+	if !ok || !stored.expiry.After(time.Now()) {
+		return nil, queue.ErrNotFound
+	}
+	return stored.status, nil
+}
+
+func (ss *statusStore) sweep(now time.Time) {
+	for id, stored := range ss.statuses {
+		if !stored.expiry.After(now) {
+			delete(ss.statuses, id)
+		}
+	}
+	ss.lastSweep = now
+}
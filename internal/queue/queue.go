@@ -2,23 +2,167 @@ package queue
 
 import (
 	"context"
+	"errors"
+	"time"
 )
 
+// ErrFull is returned when queueing onto a queue that is at capacity.
+var ErrFull = errors.New("queue full")
+
+// ErrDuplicate is returned when a message is pushed more than once within the
+// idempotency window.
+var ErrDuplicate = errors.New("duplicate message")
+
 // Queue ...
 type Queue interface {
 	Queue([]byte) error
+	// QueueBatch queues several messages at once. Either all of the messages
+	// are queued, or none are.
+	QueueBatch([][]byte) error
+	// QueueAt queues a message that is not to be handed out by Get before
+	// the given time.
+	QueueAt([]byte, time.Time) error
 	Get(ctx context.Context) (QueuedMessage, error)
 	Remove(QueuedMessage) error
+	// Requeue puts the message back onto the queue for another attempt, and
+	// increments its attempt count.
 	Requeue(QueuedMessage) error
+	// Postpone puts the message back onto the queue, to be handed out again
+	// no sooner than the given time. The attempt count is left untouched.
+	Postpone(QueuedMessage, time.Time) error
+	// Dead removes the message from the queue and parks it on the
+	// dead-letter queue.
+	Dead(QueuedMessage) error
+	// Depth returns the number of messages in the queue, per state.
+	Depth() (Depth, error)
 	Shutdown() error
 }
 
+// Depth ...
+type Depth struct {
+	// Waiting messages are ready to be handed out.
+	Waiting int
+	// InFlight messages are handed out, but not yet removed or requeued.
+	InFlight int
+	// Scheduled messages are not due yet.
+	Scheduled int
+	// Dead messages are parked on the dead-letter queue.
+	Dead int
+}
+
 // QueuedMessage ...
 type QueuedMessage interface {
 	Message() []byte
+	// Attempts returns the number of times the message has been requeued.
+	Attempts() int
+}
+
+// Deduplicator keeps track of the idempotency keys seen within a window.
+type Deduplicator interface {
+	// Claim records the key, returning false if it was already claimed
+	// within the window.
+	Claim(key string, window time.Duration) (bool, error)
+	// Release forgets about a claimed key, e.g. when the message carrying
+	// the key could not be queued after all.
+	Release(key string) error
+}
+
+// ErrNotFound is returned when looking up a status that is not (or no longer)
+// available.
+var ErrNotFound = errors.New("not found")
+
+// StatusStore keeps track of the status of messages for a limited period.
+type StatusStore interface {
+	SetStatus(id string, status []byte, retention time.Duration) error
+	GetStatus(id string) ([]byte, error)
+}
+
+// ErrInvalidCursor is returned when reading feedback using a malformed cursor.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// FeedbackEntry ...
+type FeedbackEntry struct {
+	ID   string
+	Data []byte
+}
+
+// FeedbackStore keeps feedback entries until they are acknowledged by the
+// consumer.
+type FeedbackStore interface {
+	// Append adds an entry, returning its ID. IDs are increasing, so that
+	// they can be used as a cursor.
+	Append(data []byte) (string, error)
+	// Read returns at most count entries following the cursor, leaving them
+	// in place. An empty cursor reads from the oldest entry.
+	Read(cursor string, count int) ([]FeedbackEntry, error)
+	// Ack discards the entries up to and including the cursor.
+	Ack(cursor string) error
+	// Last returns the ID of the most recent entry, if any, so that reading
+	// can start from there.
+	Last() (string, error)
+}
+
+// SquashedBatch is a batch of squashed messages, taken from a SquashStore to
+// be pushed.
+type SquashedBatch struct {
+	Key      string
+	Messages [][]byte
+	// Failures is the number of attempts to push the batch that failed
+	// temporarily.
+	Failures int
+	// Handle identifies the batch within the store.
+	Handle any
+}
+
+// SquashStore keeps track of the rate at which messages are pushed per squash
+// key, and of the batches of messages squashed as that rate was exceeded.
+type SquashStore interface {
+	// Acquire records a push to the key, unless max pushes were recorded
+	// within the period already. In that case, the time at which the period
+	// frees up is returned instead.
+	Acquire(key string, max int, per time.Duration) (acquired bool, freeAt time.Time, err error)
+	// Record records a push to the key, regardless of the rate.
+	Record(key string, per time.Duration) error
+	// Squash adds the message taken from the queue to the batch of the key,
+	// which is due at the given time unless already pending. The store
+	// takes over the message from the queue.
+	Squash(q Queue, qm QueuedMessage, key string, due time.Time) error
+	// Take claims the batch that is due first, if due by the given time. If
+	// none is, the time at which the first batch is due is returned instead
+	// (zero if there are none).
+	Take(by time.Time) (b *SquashedBatch, next time.Time, err error)
+	// Done discards the messages of the batch, as it was pushed (or failed
+	// permanently). Messages squashed since the batch was taken are due at
+	// the given time.
+	Done(b *SquashedBatch, next time.Time) error
+	// Dead moves the messages of the batch to the dead-letter queue.
+	// Messages squashed since the batch was taken are due at the given
+	// time.
+	Dead(b *SquashedBatch, next time.Time) error
+	// Retry puts the batch back, along with its failure count, to be taken
+	// again once due.
+	Retry(b *SquashedBatch, due time.Time) error
+	// Pending returns the number of batches pending.
+	Pending() (int, error)
+	// Persistent tells whether or not the pending batches survive a
+	// restart, in which case they need not be flushed when shutting down.
+	Persistent() bool
+}
+
+// KeyCounter is implemented by squash stores that keep track of the squash
+// keys in process memory.
+type KeyCounter interface {
+	// TrackedKeys returns the number of squash keys kept track of.
+	TrackedKeys() int
 }
 
 // QueueFactory ...
 type QueueFactory interface {
 	NewQueue(id string) (Queue, error)
+	NewDeduplicator(id string) (Deduplicator, error)
+	NewStatusStore() (StatusStore, error)
+	// NewFeedbackStore returns the feedback store of the given consumer,
+	// the empty one being the feedback served through the API.
+	NewFeedbackStore(consumer string) (FeedbackStore, error)
+	NewSquashStore(id string) (SquashStore, error)
 }
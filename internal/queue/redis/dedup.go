@@ -0,0 +1,50 @@
+package redis
+
+import (
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"github.com/gomodule/redigo/redis"
+)
+
+type redisDeduplicator struct {
+	pool      *redis.Pool
+	serviceID string
+}
+
+// IdempotencyKeyName returns the Redis key used to claim an idempotency key.
+func IdempotencyKeyName(serviceID, key string) string {
+	return ListName(serviceID) + ":idempotency:" + key
+}
+
+// ClaimIdempotencyKey records the idempotency key, returning false if it was
+// already claimed within the window.
+func ClaimIdempotencyKey(conn redis.Conn, serviceID, key string, window time.Duration) (bool, error) {
+	_, err := redis.String(conn.Do("SET", IdempotencyKeyName(serviceID, key), 1, "NX", "PX", window.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseIdempotencyKey ...
+func ReleaseIdempotencyKey(conn redis.Conn, serviceID, key string) (err error) {
+	_, err = conn.Do("DEL", IdempotencyKeyName(serviceID, key))
+	return
+}
+
+func (rd redisDeduplicator) Claim(key string, window time.Duration) (bool, error) {
+	conn := rd.pool.Get()
+	defer conn.Close()
+	return ClaimIdempotencyKey(conn, rd.serviceID, key, window)
+}
+
+func (rd redisDeduplicator) Release(key string) error {
+	conn := rd.pool.Get()
+	defer conn.Close()
+	return ReleaseIdempotencyKey(conn, rd.serviceID, key)
+}
+
+func (rqf *redisQueueFactory) NewDeduplicator(id string) (queue.Deduplicator, error) {
+	return redisDeduplicator{pool: rqf.pool, serviceID: id}, nil
+}
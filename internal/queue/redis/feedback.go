@@ -0,0 +1,136 @@
+package redis
+
+import (
+	"fmt"
+	"regexp"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"github.com/gomodule/redigo/redis"
+)
+
+// FeedbackStreamName is the Redis stream holding the feedback entries, shared
+// by all Shove instances. The feedback of other consumers is held in streams
+// named after the consumer, e.g. "shove:feedback:callback".
+const FeedbackStreamName = "shove:feedback"
+
+const feedbackField = "data"
+
+var streamIDPattern = regexp.MustCompile(`^\d+(-\d+)?$`)
+
+// ackScript deletes the entries up to and including the given ID. XTRIM
+// MINID would do, but requires Redis 6.2.
+var ackScript = redis.NewScript(1, `
+local entries = redis.call('XRANGE', KEYS[1], '-', ARGV[1])
+for _, entry in ipairs(entries) do
+	redis.call('XDEL', KEYS[1], entry[1])
+end
+return #entries
+`)
+
+type redisFeedbackStore struct {
+	pool   *redis.Pool
+	stream string
+}
+
+func (rfs redisFeedbackStore) Append(data []byte) (id string, err error) {
+	conn := rfs.pool.Get()
+	defer conn.Close()
+	return redis.String(conn.Do("XADD", rfs.stream, "*", feedbackField, data))
+}
+
+func (rfs redisFeedbackStore) Read(cursor string, count int) (entries []queue.FeedbackEntry, err error) {
+	if cursor == "" {
+		cursor = "0"
+	} else if !streamIDPattern.MatchString(cursor) {
+		err = queue.ErrInvalidCursor
+		return
+	}
+	conn := rfs.pool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("XREAD", "COUNT", count, "STREAMS", rfs.stream, cursor))
+	if err == redis.ErrNil {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	// The reply holds a [stream, [[id, [field, value, ...]], ...]] pair
+	// per stream read.
+	for _, stream := range reply {
+		var streamReply []interface{}
+		if streamReply, err = redis.Values(stream, nil); err != nil {
+			return
+		}
+		if len(streamReply) != 2 {
+			err = fmt.Errorf("unexpected XREAD reply")
+			return
+		}
+		var items []interface{}
+		if items, err = redis.Values(streamReply[1], nil); err != nil {
+			return
+		}
+		for _, item := range items {
+			var entry queue.FeedbackEntry
+			if entry, err = parseStreamEntry(item); err != nil {
+				return
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+func parseStreamEntry(item interface{}) (entry queue.FeedbackEntry, err error) {
+	pair, err := redis.Values(item, nil)
+	if err != nil {
+		return
+	}
+	if len(pair) != 2 {
+		err = fmt.Errorf("unexpected stream entry")
+		return
+	}
+	if entry.ID, err = redis.String(pair[0], nil); err != nil {
+		return
+	}
+	fields, err := redis.ByteSlices(pair[1], nil)
+	if err != nil {
+		return
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if string(fields[i]) == feedbackField {
+			entry.Data = fields[i+1]
+		}
+	}
+	return
+}
+
+func (rfs redisFeedbackStore) Last() (id string, err error) {
+	conn := rfs.pool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("XREVRANGE", rfs.stream, "+", "-", "COUNT", 1))
+	if err != nil || len(reply) == 0 {
+		return
+	}
+	entry, err := parseStreamEntry(reply[0])
+	id = entry.ID
+	return
+}
+
+func (rfs redisFeedbackStore) Ack(cursor string) (err error) {
+	if !streamIDPattern.MatchString(cursor) {
+		return queue.ErrInvalidCursor
+	}
+	conn := rfs.pool.Get()
+	defer conn.Close()
+	_, err = ackScript.Do(conn, rfs.stream, cursor)
+	return
+}
+
+func (rqf *redisQueueFactory) NewFeedbackStore(consumer string) (queue.FeedbackStore, error) {
+	stream := FeedbackStreamName
+	if consumer != "" {
+		stream += ":" + consumer
+	}
+	return redisFeedbackStore{pool: rqf.pool, stream: stream}, nil
+}
@@ -2,6 +2,8 @@ package redis
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"time"
 
 	"codeberg.org/pennersr/redq"
@@ -14,7 +16,24 @@ type redisQueueFactory struct {
 }
 
 type redisQueue struct {
-	q *redq.RedQueue
+	q            *redq.RedQueue
+	pool         *redis.Pool
+	waitingList  string
+	pendingList  string
+	deadList     string
+	scheduledSet string
+	attemptsHash string
+	id           string
+	stop         context.CancelFunc
+}
+
+type redisQueuedMessage struct {
+	redq.QueuedMessage
+	attempts int
+}
+
+func (qm redisQueuedMessage) Attempts() int {
+	return qm.attempts
 }
 
 // NewQueueFactory ...
@@ -31,24 +50,146 @@ func NewQueueFactory(url string) queue.QueueFactory {
 	return qf
 }
 
+// attemptsField returns the field of the attempts hash that is used to keep
+// track of the attempt count of a message. Identical messages share their
+// attempt count.
+func attemptsField(msg []byte) string {
+	digest := sha1.Sum(msg)
+	return hex.EncodeToString(digest[:])
+}
+
 func (rq redisQueue) Queue(msg []byte) (err error) {
 	return rq.q.Queue(msg)
 }
 
+func (rq redisQueue) QueueBatch(msgs [][]byte) (err error) {
+	conn := rq.pool.Get()
+	defer conn.Close()
+	return QueueMessages(conn, rq.id, msgs, nil)
+}
+
+func (rq redisQueue) QueueAt(msg []byte, due time.Time) (err error) {
+	conn := rq.pool.Get()
+	defer conn.Close()
+	return ScheduleMessage(conn, rq.id, msg, due)
+}
+
 func (rq redisQueue) Get(ctx context.Context) (qm queue.QueuedMessage, err error) {
-	qm, err = rq.q.Get(ctx)
+	raw, err := rq.q.Get(ctx)
+	if err != nil {
+		return
+	}
+	conn := rq.pool.Get()
+	defer conn.Close()
+	attempts, err := redis.Int(conn.Do("HGET", rq.attemptsHash, attemptsField(raw)))
+	if err == redis.ErrNil {
+		err = nil
+	}
+	qm = redisQueuedMessage{QueuedMessage: raw, attempts: attempts}
+	return
+}
+
+func (rq redisQueue) Depth() (depth queue.Depth, err error) {
+	conn := rq.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("LLEN", rq.waitingList)
+	conn.Send("LLEN", rq.pendingList)
+	conn.Send("ZCARD", rq.scheduledSet)
+	conn.Send("LLEN", rq.deadList)
+	counts, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	depth = queue.Depth{
+		Waiting:   counts[0],
+		InFlight:  counts[1],
+		Scheduled: counts[2],
+		Dead:      counts[3],
+	}
 	return
 }
 
 func (rq redisQueue) Remove(qm queue.QueuedMessage) (err error) {
-	return rq.q.Remove(qm.(redq.QueuedMessage))
+	msg := qm.Message()
+	conn := rq.pool.Get()
+	defer conn.Close()
+	if err = conn.Send("MULTI"); err != nil {
+		return
+	}
+	if err = conn.Send("LREM", rq.pendingList, 1, msg); err != nil {
+		return
+	}
+	if err = conn.Send("HDEL", rq.attemptsHash, attemptsField(msg)); err != nil {
+		return
+	}
+	_, err = conn.Do("EXEC")
+	return
 }
 
 func (rq redisQueue) Requeue(qm queue.QueuedMessage) (err error) {
-	return rq.q.Requeue(qm.(redq.QueuedMessage))
+	msg := qm.Message()
+	conn := rq.pool.Get()
+	defer conn.Close()
+	if err = conn.Send("MULTI"); err != nil {
+		return
+	}
+	if err = conn.Send("LREM", rq.pendingList, 1, msg); err != nil {
+		return
+	}
+	if err = conn.Send("RPUSH", rq.waitingList, msg); err != nil {
+		return
+	}
+	if err = conn.Send("HINCRBY", rq.attemptsHash, attemptsField(msg), 1); err != nil {
+		return
+	}
+	_, err = conn.Do("EXEC")
+	return
+}
+
+func (rq redisQueue) Postpone(qm queue.QueuedMessage, due time.Time) (err error) {
+	msg := qm.Message()
+	member, err := scheduledMember(msg)
+	if err != nil {
+		return
+	}
+	conn := rq.pool.Get()
+	defer conn.Close()
+	if err = conn.Send("MULTI"); err != nil {
+		return
+	}
+	if err = conn.Send("LREM", rq.pendingList, 1, msg); err != nil {
+		return
+	}
+	if err = conn.Send("ZADD", rq.scheduledSet, scheduledScore(due), member); err != nil {
+		return
+	}
+	_, err = conn.Do("EXEC")
+	return
+}
+
+func (rq redisQueue) Dead(qm queue.QueuedMessage) (err error) {
+	msg := qm.Message()
+	conn := rq.pool.Get()
+	defer conn.Close()
+	if err = conn.Send("MULTI"); err != nil {
+		return
+	}
+	if err = conn.Send("LREM", rq.pendingList, 1, msg); err != nil {
+		return
+	}
+	if err = conn.Send("RPUSH", rq.deadList, msg); err != nil {
+		return
+	}
+	if err = conn.Send("HDEL", rq.attemptsHash, attemptsField(msg)); err != nil {
+		return
+	}
+	_, err = conn.Do("EXEC")
+	return
 }
 
 func (rq redisQueue) Shutdown() (err error) {
+	rq.stop()
 	return rq.q.Close()
 }
 
@@ -58,7 +199,20 @@ func (rqf *redisQueueFactory) NewQueue(id string) (q queue.Queue, err error) {
 	if err != nil {
 		return
 	}
-	q = redisQueue{q: rq}
+	ctx, stop := context.WithCancel(context.Background())
+	rdq := redisQueue{
+		q:            rq,
+		pool:         rqf.pool,
+		id:           id,
+		waitingList:  waitingList,
+		pendingList:  pendingListName(id),
+		deadList:     DeadListName(id),
+		scheduledSet: ScheduledSetName(id),
+		attemptsHash: waitingList + ":attempts",
+		stop:         stop,
+	}
+	go rdq.servePromotions(ctx)
+	q = rdq
 	return
 }
 
@@ -66,3 +220,49 @@ func (rqf *redisQueueFactory) NewQueue(id string) (q queue.Queue, err error) {
 func ListName(serviceID string) string {
 	return "shove:" + serviceID
 }
+
+// QueueMessages atomically queues the messages of a service. Messages that
+// have a (non-zero) due time are scheduled, the others are appended to the
+// waiting list using a single RPUSH. The due times may be nil.
+func QueueMessages(conn redis.Conn, serviceID string, msgs [][]byte, due []time.Time) (err error) {
+	if len(msgs) == 0 {
+		return
+	}
+	if err = conn.Send("MULTI"); err != nil {
+		return
+	}
+	waiting := redis.Args{}.Add(ListName(serviceID))
+	for i, msg := range msgs {
+		if due == nil || due[i].IsZero() {
+			waiting = waiting.Add(msg)
+			continue
+		}
+		var member []byte
+		if member, err = scheduledMember(msg); err != nil {
+			conn.Do("DISCARD")
+			return
+		}
+		if err = conn.Send("ZADD", ScheduledSetName(serviceID), scheduledScore(due[i]), member); err != nil {
+			return
+		}
+	}
+	if len(waiting) > 1 {
+		if err = conn.Send("RPUSH", waiting...); err != nil {
+			return
+		}
+	}
+	_, err = conn.Do("EXEC")
+	return
+}
+
+// pendingListName returns the Redis list name holding the messages that are
+// being processed, mirroring the naming used by redq.
+func pendingListName(serviceID string) string {
+	return ListName(serviceID) + ":pending"
+}
+
+// DeadListName returns the Redis list name of the dead-letter queue, holding
+// the messages that could not be pushed.
+func DeadListName(serviceID string) string {
+	return ListName(serviceID) + ":dead"
+}
@@ -0,0 +1,92 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/exp/slog"
+)
+
+// Scheduled messages are stored in a sorted set, scored by due time. As
+// identical members would collapse into one, every member is prefixed by a
+// unique token.
+const scheduledTokenLength = 16
+
+// promoteScript moves the due messages from the scheduled set onto the
+// waiting list.
+var promoteScript = redis.NewScript(2, `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(due) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('RPUSH', KEYS[2], string.sub(member, ARGV[3] + 1))
+end
+return #due
+`)
+
+const promoteBatchSize = 100
+
+// ScheduledSetName returns the Redis sorted set name used for messages that
+// are not due yet.
+func ScheduledSetName(serviceID string) string {
+	return ListName(serviceID) + ":scheduled"
+}
+
+func scheduledMember(msg []byte) ([]byte, error) {
+	var token [scheduledTokenLength / 2]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, err
+	}
+	member := make([]byte, 0, scheduledTokenLength+len(msg))
+	member = append(member, hex.EncodeToString(token[:])...)
+	return append(member, msg...), nil
+}
+
+func scheduledScore(due time.Time) int64 {
+	return due.UnixMilli()
+}
+
+// ScheduleMessage adds a message to the scheduled set of a service, which is
+// moved onto the waiting list once it is due.
+func ScheduleMessage(conn redis.Conn, serviceID string, msg []byte, due time.Time) (err error) {
+	member, err := scheduledMember(msg)
+	if err != nil {
+		return
+	}
+	_, err = conn.Do("ZADD", ScheduledSetName(serviceID), scheduledScore(due), member)
+	return
+}
+
+// promoteInterval is the interval at which due messages are promoted.
+const promoteInterval = time.Second
+
+// promote moves all messages that are due onto the waiting list.
+func (rq redisQueue) promote() (err error) {
+	conn := rq.pool.Get()
+	defer conn.Close()
+	now := scheduledScore(time.Now())
+	for {
+		var n int
+		n, err = redis.Int(promoteScript.Do(conn, rq.scheduledSet, rq.waitingList, now, promoteBatchSize, scheduledTokenLength))
+		if err != nil || n < promoteBatchSize {
+			return
+		}
+	}
+}
+
+func (rq redisQueue) servePromotions(ctx context.Context) {
+	ticker := time.NewTicker(promoteInterval)
+	defer ticker.Stop()
+	for {
+		if err := rq.promote(); err != nil {
+			slog.Error("Unable to promote scheduled messages", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
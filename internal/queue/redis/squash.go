@@ -0,0 +1,234 @@
+package redis
+
+import (
+	"strconv"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"github.com/gomodule/redigo/redis"
+)
+
+// squashLease is the period for which a batch taken by a Shove instance is not
+// handed out to others. In case the instance goes away while pushing the
+// batch, it is taken again once the lease expires.
+const squashLease = time.Minute
+
+// acquireScript records a push in the sorted set of the squash key, scored by
+// time, unless the maximum number of pushes within the period was reached (a
+// negative maximum meaning unlimited). Returns -1 if recorded, or else the
+// time at which the period frees up.
+var acquireScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local per = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. (now - per))
+if max < 0 or redis.call('ZCARD', KEYS[1]) < max then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], per)
+	return -1
+end
+local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return tonumber(first[2]) + per
+`)
+
+// takeScript leases the batch due first, if due, returning its key, failure
+// count and messages. If none is due, an empty key is returned along with the
+// time the first batch is due, if any.
+var takeScript = redis.NewScript(2, `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1)
+if #due == 0 then
+	local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return {'', first[2] or ''}
+end
+local key = due[1]
+redis.call('ZADD', KEYS[1], ARGV[2], key)
+local result = {key, redis.call('HGET', KEYS[2], key) or '0'}
+for _, msg in ipairs(redis.call('LRANGE', ARGV[3] .. key, 0, -1)) do
+	table.insert(result, msg)
+end
+return result
+`)
+
+// finishScript discards (or moves to the dead-letter list) the first messages
+// of a batch. Messages squashed in the meantime remain, due at the given time.
+var finishScript = redis.NewScript(4, `
+local n = tonumber(ARGV[2])
+if ARGV[4] == '1' then
+	for i = 1, n do
+		local msg = redis.call('LPOP', KEYS[3])
+		if not msg then
+			break
+		end
+		redis.call('RPUSH', KEYS[4], msg)
+	end
+else
+	redis.call('LTRIM', KEYS[3], n, -1)
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+if redis.call('LLEN', KEYS[3]) > 0 then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+else
+	redis.call('ZREM', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// redisSquashStore keeps the rates and batches in Redis, so that they are
+// shared by all Shove instances and survive restarts. Per squash key, the
+// pushes are kept in a sorted set, and the squashed messages in a list. A
+// sorted set holds the keys of the pending batches, scored by due time.
+type redisSquashStore struct {
+	pool         *redis.Pool
+	prefix       string
+	dueSet       string
+	failuresHash string
+	deadList     string
+}
+
+// SquashKeyPrefix returns the prefix of the Redis keys used for squashing.
+func SquashKeyPrefix(serviceID string) string {
+	return ListName(serviceID) + ":squash:"
+}
+
+func (rss redisSquashStore) rateSet(key string) string {
+	return rss.prefix + "rate:" + key
+}
+
+func (rss redisSquashStore) batchList(key string) string {
+	return rss.prefix + "batch:" + key
+}
+
+func (rss redisSquashStore) record(key string, max int, per time.Duration) (freeAt int64, err error) {
+	member, err := scheduledMember(nil)
+	if err != nil {
+		return
+	}
+	conn := rss.pool.Get()
+	defer conn.Close()
+	return redis.Int64(acquireScript.Do(conn, rss.rateSet(key), time.Now().UnixMilli(), per.Milliseconds(), max, member))
+}
+
+func (rss redisSquashStore) Acquire(key string, max int, per time.Duration) (acquired bool, freeAt time.Time, err error) {
+	at, err := rss.record(key, max, per)
+	if err != nil {
+		return
+	}
+	if at < 0 {
+		acquired = true
+		return
+	}
+	freeAt = time.UnixMilli(at)
+	return
+}
+
+func (rss redisSquashStore) Record(key string, per time.Duration) (err error) {
+	_, err = rss.record(key, -1, per)
+	return
+}
+
+func (rss redisSquashStore) Squash(q queue.Queue, qm queue.QueuedMessage, key string, due time.Time) (err error) {
+	conn := rss.pool.Get()
+	defer conn.Close()
+	if err = conn.Send("MULTI"); err != nil {
+		return
+	}
+	if err = conn.Send("RPUSH", rss.batchList(key), qm.Message()); err != nil {
+		return
+	}
+	if err = conn.Send("ZADD", rss.dueSet, "NX", due.UnixMilli(), key); err != nil {
+		return
+	}
+	if _, err = conn.Do("EXEC"); err != nil {
+		return
+	}
+	// Taken over by the batch, a crash in between results in the message
+	// being pushed twice rather than not at all.
+	return q.Remove(qm)
+}
+
+func (rss redisSquashStore) Take(by time.Time) (b *queue.SquashedBatch, next time.Time, err error) {
+	conn := rss.pool.Get()
+	defer conn.Close()
+	lease := time.Now().Add(squashLease).UnixMilli()
+	values, err := redis.ByteSlices(takeScript.Do(conn, rss.dueSet, rss.failuresHash, by.UnixMilli(), lease, rss.prefix+"batch:"))
+	if err != nil {
+		return
+	}
+	if len(values[0]) == 0 {
+		if len(values[1]) > 0 {
+			var at int64
+			if at, err = strconv.ParseInt(string(values[1]), 10, 64); err != nil {
+				return
+			}
+			next = time.UnixMilli(at)
+		}
+		return
+	}
+	failures, err := strconv.Atoi(string(values[1]))
+	if err != nil {
+		return
+	}
+	b = &queue.SquashedBatch{
+		Key:      string(values[0]),
+		Messages: values[2:],
+		Failures: failures,
+	}
+	return
+}
+
+func (rss redisSquashStore) finish(b *queue.SquashedBatch, next time.Time, dead bool) (err error) {
+	conn := rss.pool.Get()
+	defer conn.Close()
+	flag := "0"
+	if dead {
+		flag = "1"
+	}
+	_, err = finishScript.Do(conn, rss.dueSet, rss.failuresHash, rss.batchList(b.Key), rss.deadList,
+		b.Key, len(b.Messages), next.UnixMilli(), flag)
+	return
+}
+
+func (rss redisSquashStore) Done(b *queue.SquashedBatch, next time.Time) error {
+	return rss.finish(b, next, false)
+}
+
+func (rss redisSquashStore) Dead(b *queue.SquashedBatch, next time.Time) error {
+	return rss.finish(b, next, true)
+}
+
+func (rss redisSquashStore) Retry(b *queue.SquashedBatch, due time.Time) (err error) {
+	conn := rss.pool.Get()
+	defer conn.Close()
+	if err = conn.Send("MULTI"); err != nil {
+		return
+	}
+	if err = conn.Send("HSET", rss.failuresHash, b.Key, b.Failures); err != nil {
+		return
+	}
+	if err = conn.Send("ZADD", rss.dueSet, due.UnixMilli(), b.Key); err != nil {
+		return
+	}
+	_, err = conn.Do("EXEC")
+	return
+}
+
+func (rss redisSquashStore) Pending() (int, error) {
+	conn := rss.pool.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("ZCARD", rss.dueSet))
+}
+
+func (rss redisSquashStore) Persistent() bool {
+	return true
+}
+
+func (rqf *redisQueueFactory) NewSquashStore(id string) (queue.SquashStore, error) {
+	prefix := SquashKeyPrefix(id)
+	return redisSquashStore{
+		pool:         rqf.pool,
+		prefix:       prefix,
+		dueSet:       prefix + "due",
+		failuresHash: prefix + "failures",
+		deadList:     DeadListName(id),
+	}, nil
+}
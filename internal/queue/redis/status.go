@@ -0,0 +1,38 @@
+package redis
+
+import (
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"github.com/gomodule/redigo/redis"
+)
+
+type redisStatusStore struct {
+	pool *redis.Pool
+}
+
+// StatusKeyName returns the Redis key used to store the status of a message.
+func StatusKeyName(messageID string) string {
+	return "shove:messages:" + messageID
+}
+
+func (rss redisStatusStore) SetStatus(id string, status []byte, retention time.Duration) (err error) {
+	conn := rss.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", StatusKeyName(id), status, "PX", retention.Milliseconds())
+	return
+}
+
+func (rss redisStatusStore) GetStatus(id string) (status []byte, err error) {
+	conn := rss.pool.Get()
+	defer conn.Close()
+	status, err = redis.Bytes(conn.Do("GET", StatusKeyName(id)))
+	if err == redis.ErrNil {
+		err = queue.ErrNotFound
+	}
+	return
+}
+
+func (rqf *redisQueueFactory) NewStatusStore() (queue.StatusStore, error) {
+	return redisStatusStore{pool: rqf.pool}, nil
+}
@@ -0,0 +1,172 @@
+// Package schedule holds the messages of the in-process queues, handing them
+// out in FIFO order, and holding back the scheduled ones until they are due.
+package schedule
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrShutdown is returned when getting a message from a queue shut down.
+var ErrShutdown = errors.New("queue shut down")
+
+// Queue holds the messages waiting to be handed out. It is guarded by the
+// lock of the queue it belongs to, which must be held when calling any of its
+// methods.
+type Queue[T any] struct {
+	// ready holds the messages that are due, in FIFO order.
+	ready        *list.List
+	scheduled    entries[T]
+	timer        *time.Timer
+	cond         *sync.Cond
+	shuttingDown bool
+}
+
+// New returns a queue guarded by the lock.
+func New[T any](lock sync.Locker) *Queue[T] {
+	return &Queue[T]{
+		ready: list.New(),
+		cond:  sync.NewCond(lock),
+	}
+}
+
+// Push adds the message to the back of the queue.
+func (q *Queue[T]) Push(msg T) {
+	q.ready.PushBack(msg)
+	q.cond.Signal()
+}
+
+// Schedule adds the message to the queue once due.
+func (q *Queue[T]) Schedule(msg T, due time.Time) {
+	heap.Push(&q.scheduled, entry[T]{msg: msg, due: due})
+	q.armTimer()
+}
+
+// armTimer makes sure that waiting consumers are woken up once the first
+// scheduled message is due.
+func (q *Queue[T]) armTimer() {
+	if len(q.scheduled) == 0 {
+		return
+	}
+	d := time.Until(q.scheduled[0].due)
+	if q.timer == nil {
+		q.timer = time.AfterFunc(d, func() {
+			q.cond.L.Lock()
+			q.cond.Broadcast()
+			q.cond.L.Unlock()
+		})
+	} else {
+		q.timer.Reset(d)
+	}
+}
+
+// promote moves the scheduled messages that are due onto the queue.
+func (q *Queue[T]) promote() {
+	now := time.Now()
+	promoted := false
+	for len(q.scheduled) > 0 && !q.scheduled[0].due.After(now) {
+		e := heap.Pop(&q.scheduled).(entry[T])
+		q.ready.PushBack(e.msg)
+		promoted = true
+	}
+	if promoted {
+		q.armTimer()
+	}
+}
+
+// Get waits for a message to be due, and removes it from the queue.
+func (q *Queue[T]) Get(ctx context.Context) (msg T, err error) {
+	// Wake up when the context is done, so that a single consumer can be
+	// stopped without shutting down the queue.
+	defer context.AfterFunc(ctx, func() {
+		q.cond.L.Lock()
+		q.cond.Broadcast()
+		q.cond.L.Unlock()
+	})()
+	for ctx.Err() == nil {
+		if q.shuttingDown {
+			break
+		}
+		q.promote()
+		front := q.ready.Front()
+		if front == nil {
+			q.cond.Wait()
+			continue
+		}
+		msg = q.ready.Remove(front).(T)
+		return
+	}
+	err = ErrShutdown
+	return
+}
+
+// Shutdown wakes up all consumers, and stops handing out messages.
+func (q *Queue[T]) Shutdown() {
+	q.shuttingDown = true
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.cond.Broadcast()
+}
+
+// ShuttingDown returns whether the queue is shut down.
+func (q *Queue[T]) ShuttingDown() bool {
+	return q.shuttingDown
+}
+
+// Ready returns the number of messages that are due.
+func (q *Queue[T]) Ready() int {
+	return q.ready.Len()
+}
+
+// Scheduled returns the number of messages that are not due yet.
+func (q *Queue[T]) Scheduled() int {
+	return len(q.scheduled)
+}
+
+// Each calls the function for every message, the ones due first, passing the
+// due time of the scheduled ones.
+func (q *Queue[T]) Each(f func(msg T, due time.Time)) {
+	for e := q.ready.Front(); e != nil; e = e.Next() {
+		f(e.Value.(T), time.Time{})
+	}
+	for _, e := range q.scheduled {
+		f(e.msg, e.due)
+	}
+}
+
+type entry[T any] struct {
+	msg T
+	due time.Time
+}
+
+// entries is a min-heap of messages, ordered by due time.
+type entries[T any] []entry[T]
+
+func (s entries[T]) Len() int {
+	return len(s)
+}
+
+func (s entries[T]) Less(i, j int) bool {
+	return s[i].due.Before(s[j].due)
+}
+
+func (s entries[T]) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s *entries[T]) Push(x any) {
+	*s = append(*s, x.(entry[T]))
+}
+
+func (s *entries[T]) Pop() any {
+	old := *s
+	n := len(old)
+	e := old[n-1]
+	*s = old[:n-1]
+	return e
+}
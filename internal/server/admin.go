@@ -0,0 +1,122 @@
+package server
+
+import (
+	"codeberg.org/pennersr/shove/internal/services"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type queueStatus struct {
+	Waiting   int `json:"waiting"`
+	InFlight  int `json:"in_flight"`
+	Scheduled int `json:"scheduled"`
+	Dead      int `json:"dead"`
+}
+
+type serviceStatus struct {
+	Paused  bool                   `json:"paused"`
+	Workers int                    `json:"workers"`
+	Breaker services.BreakerStatus `json:"breaker"`
+	Queue   *queueStatus           `json:"queue,omitempty"`
+}
+
+func (w *worker) status() (status serviceStatus) {
+	status.Paused = w.pump.Paused()
+	status.Workers = w.pump.Workers()
+	status.Breaker = w.pump.BreakerStatus()
+	if depth, err := w.queue.Depth(); err == nil {
+		status.Queue = &queueStatus{
+			Waiting:   depth.Waiting,
+			InFlight:  depth.InFlight,
+			Scheduled: depth.Scheduled,
+			Dead:      depth.Dead,
+		}
+	}
+	return
+}
+
+// handleAdminStatus reports the state of the circuit breaker and the queue
+// of each service.
+func (s *Server) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	statuses := make(map[string]serviceStatus)
+	for id, wrk := range s.allWorkers() {
+		statuses[id] = wrk.status()
+	}
+	if s.callback != nil {
+		statuses[s.callback.worker.service.ID()] = s.callback.worker.status()
+	}
+	j, err := json.Marshal(struct {
+		Services map[string]serviceStatus `json:"services"`
+	}{statuses})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// handleAdminReload reloads the configuration, reconciling the services.
+func (s *Server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if s.reload == nil {
+		http.Error(w, "Reloading is not supported.", http.StatusNotImplemented)
+		return
+	}
+	if err := s.reload(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminService controls the pump of a service:
+//
+//	POST /api/admin/services/<id>/pause
+//	POST /api/admin/services/<id>/resume
+//	POST /api/admin/services/<id>/workers?count=N
+func (s *Server) handleAdminService(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	id, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/services/"), "/")
+	if !ok {
+		http.Error(w, "Not found.", 404)
+		return
+	}
+	wrk, ok := s.lookupWorker(id)
+	if !ok {
+		http.Error(w, "Unknown service.", 404)
+		return
+	}
+	switch action {
+	case "pause":
+		wrk.pump.Pause()
+	case "resume":
+		wrk.pump.Resume()
+	case "workers":
+		count, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil || count < 1 {
+			http.Error(w, "Invalid worker count.", 400)
+			return
+		}
+		if err = wrk.pump.SetWorkers(count); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	default:
+		http.Error(w, "Not found.", 404)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
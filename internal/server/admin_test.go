@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+	"codeberg.org/pennersr/shove/internal/services"
+	"codeberg.org/pennersr/shove/internal/services/webhook"
+	"golang.org/x/exp/slog"
+)
+
+func TestReconcileServices(t *testing.T) {
+	s, err := NewServer("", memory.MemoryQueueFactory{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	wh, _ := webhook.NewWebhookWithConfig(webhook.Config{ID: "hooks"}, slog.Default())
+	if err = s.AddService(wh, services.PumpConfig{Workers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddService(wh, services.PumpConfig{Workers: 1}); err == nil {
+		t.Fatal("added twice")
+	}
+	w, _ := s.lookupWorker("hooks")
+	if _, err = w.push(context.Background(), []byte(`{"url": "http://localhost/", "body": "", "delay": 3600}`), "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing keeps the queue.
+	wh, _ = webhook.NewWebhookWithConfig(webhook.Config{ID: "hooks", Retry: true}, slog.Default())
+	if err = s.ReplaceService(wh, services.PumpConfig{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	replaced, _ := s.lookupWorker("hooks")
+	if replaced == w || replaced.queue != w.queue {
+		t.Fatal("queue not kept")
+	}
+
+	// So does removing and adding again.
+	if err = s.RemoveService("hooks"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.lookupWorker("hooks"); ok {
+		t.Fatal("not removed")
+	}
+	if err = s.AddService(wh, services.PumpConfig{Workers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	readded, _ := s.lookupWorker("hooks")
+	depth, err := readded.queue.Depth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth.Scheduled != 1 {
+		t.Fatal(depth)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.RemoveService("hooks")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pump did not stop")
+	}
+}
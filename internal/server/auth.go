@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Scopes that can be granted to API keys. Pushing to a service requires the
+// scope returned by PushScope.
+const (
+	ScopeFeedback = "feedback"
+	ScopeMetrics  = "metrics"
+	ScopeAdmin    = "admin"
+	ScopeAll      = "*"
+)
+
+// PushScope returns the scope required to push to (and look up the status of
+// messages of) the given service, "*" meaning any service.
+func PushScope(service string) string {
+	return "push:" + service
+}
+
+// APIKey ...
+type APIKey struct {
+	// Name identifies the key in logs and metrics, never the token itself.
+	Name   string
+	Token  string
+	Scopes []string
+}
+
+func (k *APIKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAll {
+			return true
+		}
+		if s == PushScope("*") && strings.HasPrefix(scope, PushScope("")) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAnyPush returns whether or not the key is allowed to push to at least
+// one service.
+func (k *APIKey) allowsAnyPush() bool {
+	for _, s := range k.Scopes {
+		if s == ScopeAll || strings.HasPrefix(s, PushScope("")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAPIKeys reads API keys, one per line, formatted as:
+//
+//	<name> <token> <scope>[,<scope>...]
+//
+// Empty lines and lines starting with a "#" are skipped.
+func ParseAPIKeys(r io.Reader) (keys []APIKey, err error) {
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			err = fmt.Errorf("line %d: expected name, token and scopes", lineno)
+			return
+		}
+		keys = append(keys, APIKey{
+			Name:   fields[0],
+			Token:  fields[1],
+			Scopes: strings.Split(fields[2], ","),
+		})
+	}
+	err = scanner.Err()
+	return
+}
+
+// LoadAPIKeys reads the API keys from a file, see ParseAPIKeys.
+func LoadAPIKeys(path string) (keys []APIKey, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return ParseAPIKeys(f)
+}
+
+type apiKeyContextKey struct{}
+
+// tokenDigest is used to look up keys, so that the lookup time does not
+// depend on the token being guessed.
+func tokenDigest(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
+
+// statusRecorder captures the status code written, for use in metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// endpointOf returns the endpoint label of a request path, keeping the
+// cardinality of the metric bounded.
+func endpointOf(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if parts[0] == "api" && len(parts) > 1 {
+		switch parts[1] {
+		case "push", "feedback", "messages", "admin":
+			return parts[1]
+		}
+	} else if parts[0] == "metrics" {
+		return parts[0]
+	}
+	return "other"
+}
+
+// authenticate resolves the API key from the bearer token of the request,
+// rejecting unauthenticated requests in case API keys are configured. The
+// usage is recorded per key.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		keyName := "anonymous"
+		defer func() {
+			apiRequestsCounter.WithLabelValues(keyName, endpointOf(r.URL.Path), strconv.Itoa(sr.status)).Inc()
+		}()
+		if len(s.apiKeys) == 0 {
+			next.ServeHTTP(sr, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		key, found := s.apiKeys[tokenDigest(strings.TrimSpace(token))]
+		if !ok || !found {
+			sr.Header().Set("WWW-Authenticate", `Bearer realm="shove"`)
+			http.Error(sr, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		keyName = key.Name
+		ctx := context.WithValue(r.Context(), apiKeyContextKey{}, key)
+		next.ServeHTTP(sr, r.WithContext(ctx))
+	})
+}
+
+// authorized wraps a handler that requires the given scope.
+func (s *Server) authorized(scope string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authorize(w, r, scope) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorize checks whether the request is allowed the given scope, writing a
+// 403 response if not.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, scope string) bool {
+	if !s.allowed(r, func(key *APIKey) bool { return key.allows(scope) }) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// allowed returns whether or not the API key of the request passes the check,
+// which is always the case if no API keys are configured.
+func (s *Server) allowed(r *http.Request, check func(*APIKey) bool) bool {
+	if len(s.apiKeys) == 0 {
+		return true
+	}
+	key, ok := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return ok && check(key)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+	"codeberg.org/pennersr/shove/internal/services"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys(strings.NewReader(`
+# Comment
+backend s3cr3t push:webhook,feedback
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Name != "backend" || keys[0].Token != "s3cr3t" {
+		t.Fatal(keys)
+	}
+	key := keys[0]
+	if !key.allows(PushScope("webhook")) || !key.allows(ScopeFeedback) {
+		t.Fatal("scope not granted")
+	}
+	if key.allows(PushScope("apns")) || key.allows(ScopeMetrics) {
+		t.Fatal("scope granted")
+	}
+	if _, err = ParseAPIKeys(strings.NewReader("backend s3cr3t")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s, err := NewServer("", memory.MemoryQueueFactory{}, Config{
+		APIKeys: []APIKey{
+			{Name: "backend", Token: "s3cr3t", Scopes: []string{PushScope("*")}},
+			{Name: "monitoring", Token: "m0n", Scopes: []string{ScopeMetrics, ScopeFeedback}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		token  string
+		path   string
+		status int
+	}{
+		{"", "/api/feedback", http.StatusUnauthorized},
+		{"wrong", "/api/feedback", http.StatusUnauthorized},
+		{"s3cr3t", "/api/feedback", http.StatusForbidden},
+		{"s3cr3t", "/metrics", http.StatusForbidden},
+		{"s3cr3t", "/api/push/webhook", http.StatusNotFound},
+		{"m0n", "/api/push/webhook", http.StatusForbidden},
+		{"m0n", "/api/feedback", http.StatusOK},
+		{"m0n", "/metrics", http.StatusOK},
+	} {
+		r := httptest.NewRequest("POST", tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s %s: %d", tc.token, tc.path, w.Code)
+		}
+	}
+}
+
+func TestMessageStatusAuthorization(t *testing.T) {
+	s, err := NewServer("", memory.MemoryQueueFactory{}, Config{
+		StatusRetention: time.Hour,
+		APIKeys: []APIKey{
+			{Name: "apns", Token: "apns", Scopes: []string{PushScope("apns")}},
+			{Name: "webhook", Token: "webhook", Scopes: []string{PushScope("webhook")}},
+			{Name: "monitoring", Token: "m0n", Scopes: []string{ScopeMetrics}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TrackMessage(services.MessageStatus{ID: "known", Service: "apns", State: services.MessageQueued})
+	for _, tc := range []struct {
+		token  string
+		id     string
+		status int
+	}{
+		{"apns", "known", http.StatusOK},
+		{"apns", "unknown", http.StatusNotFound},
+		// Messages of other services look unknown.
+		{"webhook", "known", http.StatusNotFound},
+		{"webhook", "unknown", http.StatusNotFound},
+		{"m0n", "known", http.StatusForbidden},
+		{"m0n", "unknown", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/api/messages/"+tc.id, nil)
+		r.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s %s: %d", tc.token, tc.id, w.Code)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"codeberg.org/pennersr/shove/internal/queue"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	batchAccepted = "accepted"
+	batchRejected = "rejected"
+)
+
+type batchResult struct {
+	Status string `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+	err    error
+}
+
+func accepted(id string) batchResult {
+	return batchResult{Status: batchAccepted, ID: id}
+}
+
+func rejected(err error) batchResult {
+	return batchResult{Status: batchRejected, Error: err.Error(), err: err}
+}
+
+// parseBatch splits the body into messages. The body is either a JSON array,
+// or a stream of newline delimited JSON (NDJSON) messages.
+func parseBatch(body []byte) (msgs [][]byte, err error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err = json.Unmarshal(trimmed, &items); err != nil {
+			return
+		}
+		msgs = make([][]byte, len(items))
+		for i, item := range items {
+			msgs[i] = item
+		}
+		return
+	}
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		msgs = append(msgs, line)
+	}
+	return
+}
+
+func (s *Server) handleBatchPush(w http.ResponseWriter, r *http.Request, service string) {
+	if !s.authorize(w, r, PushScope(service)) {
+		return
+	}
+	wrk, ok := s.lookupWorker(service)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msgs, err := parseBatch(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, span := startPushSpan(r, service)
+	results := wrk.pushBatch(ctx, msgs, s.config.IdempotencyWindow)
+	span.End()
+	anyAccepted, full := false, false
+	for _, result := range results {
+		if result.Status == batchAccepted {
+			anyAccepted = true
+		} else if errors.Is(result.err, queue.ErrFull) {
+			full = true
+		}
+	}
+	j, err := json.Marshal(struct {
+		Results []batchResult `json:"results"`
+	}{Results: results})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if full {
+		// Let the producer back off.
+		w.Header().Set("Retry-After", "1")
+	}
+	status := http.StatusAccepted
+	if !anyAccepted && len(results) > 0 {
+		status = http.StatusUnprocessableEntity
+		if full {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+	"codeberg.org/pennersr/shove/internal/services"
+	"codeberg.org/pennersr/shove/internal/services/webhook"
+	"golang.org/x/exp/slog"
+)
+
+func TestParseBatch(t *testing.T) {
+	for _, body := range []string{
+		`[{"a": 1}, {"b": 2}]`,
+		"{\"a\": 1}\n\n{\"b\": 2}\n",
+	} {
+		msgs, err := parseBatch([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 2 || string(msgs[0]) != `{"a": 1}` || string(msgs[1]) != `{"b": 2}` {
+			t.Fatalf("%q", msgs)
+		}
+	}
+}
+
+// newBatchServer returns a server with a webhook service, the upstream of
+// which holds on to the messages pushed until the test ends, so that they
+// stay in the queue.
+func newBatchServer(t *testing.T, capacity int) (s *Server, url string) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+	s, err := NewServer("", memory.MemoryQueueFactory{Capacity: capacity}, Config{IdempotencyWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh, _ := webhook.NewWebhookWithConfig(webhook.Config{ID: "hooks"}, slog.Default())
+	if err = s.AddService(wh, services.PumpConfig{Workers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return s, upstream.URL
+}
+
+func pushBatch(t *testing.T, s *Server, body string) (w *httptest.ResponseRecorder, results []batchResult) {
+	w = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/push/hooks/batch", strings.NewReader(body)))
+	var resp struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	return w, resp.Results
+}
+
+func statuses(results []batchResult) (s []string) {
+	for _, result := range results {
+		s = append(s, result.Status)
+	}
+	return
+}
+
+func TestBatchPush(t *testing.T) {
+	s, url := newBatchServer(t, 0)
+	msg := func(extra string) string {
+		return `{"url": "` + url + `", "body": ""` + extra + `}`
+	}
+	sendAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	// Valid, invalid, duplicated within the batch, and scheduled messages.
+	w, results := pushBatch(t, s, "["+strings.Join([]string{
+		msg(`, "id": "a"`),
+		`{"url": "not a url"}`,
+		msg(`, "id": "a"`),
+		msg(`, "send_at": "` + sendAt + `"`),
+	}, ", ")+"]")
+	if w.Code != http.StatusAccepted {
+		t.Fatal(w.Code)
+	}
+	if got := strings.Join(statuses(results), " "); got != "accepted rejected rejected accepted" {
+		t.Fatal(got)
+	}
+	if results[2].Error != queue.ErrDuplicate.Error() || results[0].ID == "" || results[3].ID == "" {
+		t.Fatal(results)
+	}
+	depth, _ := s.workers["hooks"].queue.Depth()
+	if depth.Scheduled != 1 || depth.Waiting+depth.InFlight != 1 {
+		t.Fatal(depth)
+	}
+
+	// Duplicated across batches, nothing is accepted.
+	w, results = pushBatch(t, s, msg(`, "id": "a"`))
+	if w.Code != http.StatusUnprocessableEntity || results[0].Error != queue.ErrDuplicate.Error() {
+		t.Fatal(w.Code, results)
+	}
+}
+
+func TestBatchPushFull(t *testing.T) {
+	s, url := newBatchServer(t, 1)
+	msg := `{"url": "` + url + `", "body": ""}`
+	if w, _ := pushBatch(t, s, msg); w.Code != http.StatusAccepted {
+		t.Fatal(w.Code)
+	}
+	w, results := pushBatch(t, s, msg+"\n"+msg)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatal(w.Code, w.Header())
+	}
+	for _, result := range results {
+		if result.Error != queue.ErrFull.Error() {
+			t.Fatal(results)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/services"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"sync"
+	"time"
+)
+
+// SignatureHeader holds the HMAC-SHA256 signature of feedback callbacks,
+// computed over the body using the callback secret.
+const SignatureHeader = "X-Shove-Signature"
+
+const (
+	defaultCallbackBatchSize     = 100
+	defaultCallbackBatchInterval = time.Second
+)
+
+// FeedbackCallbackConfig ...
+type FeedbackCallbackConfig struct {
+	// URL receives the feedback of all services, unless overridden by
+	// ServiceURLs.
+	URL         string
+	ServiceURLs map[string]string
+	// Secret is used to sign the callbacks.
+	Secret string
+	// BatchSize is the max. number of feedback entries per callback, and
+	// BatchInterval the max. time an entry is held back.
+	BatchSize     int
+	BatchInterval time.Duration
+}
+
+// feedbackCallback batches feedback per URL, and queues the batches onto a
+// webhook service, which takes care of delivery and retries. The feedback
+// posted is kept in a store of its own, acknowledged once queued, so that it
+// is replayed after a restart.
+type feedbackCallback struct {
+	config FeedbackCallbackConfig
+	worker *worker
+	store  queue.FeedbackStore
+	lock   sync.Mutex
+	// unacked holds the IDs of the stored feedback in order, and buffered
+	// those not queued yet, so that the store is only acknowledged up to the
+	// first feedback still buffered.
+	unacked  []string
+	buffered map[string]bool
+	batches  map[string][]tokenFeedback
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newFeedbackCallback(config FeedbackCallbackConfig, w *worker, store queue.FeedbackStore) *feedbackCallback {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultCallbackBatchSize
+	}
+	if config.BatchInterval <= 0 {
+		config.BatchInterval = defaultCallbackBatchInterval
+	}
+	return &feedbackCallback{
+		config:   config,
+		worker:   w,
+		store:    store,
+		buffered: make(map[string]bool),
+		batches:  make(map[string][]tokenFeedback),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (cb *feedbackCallback) url(service string) string {
+	if url, ok := cb.config.ServiceURLs[service]; ok {
+		return url
+	}
+	return cb.config.URL
+}
+
+// covers returns whether the feedback of the service is posted.
+func (cb *feedbackCallback) covers(service string) bool {
+	return cb.url(service) != ""
+}
+
+// add stores the feedback and buffers it for the next callback.
+func (cb *feedbackCallback) add(fb tokenFeedback) (err error) {
+	j, err := json.Marshal(fb)
+	if err != nil {
+		return
+	}
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if fb.ID, err = cb.store.Append(j); err != nil {
+		return
+	}
+	cb.buffer(fb)
+	return
+}
+
+func (cb *feedbackCallback) buffer(fb tokenFeedback) {
+	url := cb.url(fb.Service)
+	cb.unacked = append(cb.unacked, fb.ID)
+	cb.buffered[fb.ID] = true
+	cb.batches[url] = append(cb.batches[url], fb)
+	if len(cb.batches[url]) >= cb.config.BatchSize {
+		cb.flush(url)
+	}
+}
+
+// replay buffers the feedback left in the store by a previous run. Feedback
+// of services no longer covered is handed back to the server.
+func (cb *feedbackCallback) replay(s *Server) (err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cursor := ""
+	for {
+		var entries []queue.FeedbackEntry
+		if entries, err = cb.store.Read(cursor, maxFeedbackCount); err != nil || len(entries) == 0 {
+			return
+		}
+		var feedback []tokenFeedback
+		if feedback, err = decodeFeedback(entries); err != nil {
+			return
+		}
+		for _, fb := range feedback {
+			if cb.covers(fb.Service) {
+				cb.buffer(fb)
+				continue
+			}
+			cb.unacked = append(cb.unacked, fb.ID)
+			fb.ID = ""
+			s.storeFeedback(fb)
+		}
+		cursor = entries[len(entries)-1].ID
+		slog.Info("Replaying feedback callbacks", "count", len(entries))
+	}
+}
+
+func (cb *feedbackCallback) flushAll() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	for url := range cb.batches {
+		cb.flush(url)
+	}
+	cb.ack()
+}
+
+func (cb *feedbackCallback) flush(url string) {
+	batch := cb.batches[url]
+	if len(batch) == 0 {
+		delete(cb.batches, url)
+		return
+	}
+	msg, err := cb.message(url, batch)
+	if err == nil {
+		_, err = cb.worker.push(context.Background(), msg, "", 0)
+	}
+	if err != nil {
+		// Kept for the next flush.
+		slog.Error("Unable to queue feedback callback", "url", url, "error", err)
+		return
+	}
+	delete(cb.batches, url)
+	for _, fb := range batch {
+		delete(cb.buffered, fb.ID)
+	}
+	cb.ack()
+}
+
+// ack acknowledges the stored feedback up to the first one still buffered.
+func (cb *feedbackCallback) ack() {
+	n := 0
+	for n < len(cb.unacked) && !cb.buffered[cb.unacked[n]] {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	if err := cb.store.Ack(cb.unacked[n-1]); err != nil {
+		slog.Error("Unable to acknowledge feedback", "error", err)
+		return
+	}
+	cb.unacked = cb.unacked[n:]
+}
+
+// message returns the webhook message posting the batch to the URL.
+func (cb *feedbackCallback) message(url string, batch []tokenFeedback) (msg []byte, err error) {
+	body, err := json.Marshal(newFeedbackPage(batch))
+	if err != nil {
+		return
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	if cb.config.Secret != "" {
+		headers[SignatureHeader] = "sha256=" + sign(cb.config.Secret, body)
+	}
+	return json.Marshal(struct {
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+	}{URL: url, Headers: headers, Body: string(body)})
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cb *feedbackCallback) serve() {
+	defer close(cb.stopped)
+	ticker := time.NewTicker(cb.config.BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cb.flushAll()
+		case <-cb.stop:
+			cb.flushAll()
+			return
+		}
+	}
+}
+
+// shutdown queues the pending batches, and stops the webhook service.
+func (cb *feedbackCallback) shutdown(ctx context.Context) error {
+	close(cb.stop)
+	<-cb.stopped
+	return cb.worker.shutdown(ctx)
+}
+
+// SetFeedbackCallback configures feedback to be delivered through callbacks,
+// using the given webhook service.
+func (s *Server) SetFeedbackCallback(wh services.PushService, config FeedbackCallbackConfig, pumpConfig services.PumpConfig) (err error) {
+	slog.Info("Initializing feedback callbacks", "service", wh)
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+	if _, ok := s.workers[wh.ID()]; ok {
+		err = fmt.Errorf("duplicate service ID %q", wh.ID())
+		return
+	}
+	store, err := s.queueFactory.NewFeedbackStore("callback")
+	if err != nil {
+		return
+	}
+	w, err := s.newWorker(wh, pumpConfig)
+	if err != nil {
+		return
+	}
+	go w.serve()
+	cb := newFeedbackCallback(config, w, store)
+	if err = cb.replay(s); err != nil {
+		return
+	}
+	s.callback = cb
+	go cb.serve()
+	return
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue/disk"
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+	"codeberg.org/pennersr/shove/internal/services"
+	"codeberg.org/pennersr/shove/internal/services/webhook"
+	"golang.org/x/exp/slog"
+)
+
+func TestFeedbackCallback(t *testing.T) {
+	received := make(chan []tokenFeedback, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != "sha256="+sign("s3cr3t", body) {
+			t.Error("bad signature", r.Header.Get(SignatureHeader))
+		}
+		var data struct {
+			Feedback []tokenFeedback `json:"feedback"`
+		}
+		if err := json.Unmarshal(body, &data); err != nil {
+			t.Error(err)
+		}
+		received <- data.Feedback
+	}))
+	defer upstream.Close()
+
+	s, err := NewServer("", memory.MemoryQueueFactory{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh, _ := webhook.NewWebhookWithConfig(webhook.Config{ID: "feedback-callback"}, slog.Default())
+	err = s.SetFeedbackCallback(wh, FeedbackCallbackConfig{
+		URL:           upstream.URL,
+		Secret:        "s3cr3t",
+		BatchSize:     2,
+		BatchInterval: time.Minute,
+	}, services.PumpConfig{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.callback.shutdown(context.Background())
+	s.TokenInvalid("apns", "abc")
+	s.ReplaceToken("fcm", "def", "ghi")
+
+	select {
+	case feedback := <-received:
+		if len(feedback) != 2 || feedback[0].Token != "abc" || feedback[1].Replacement != "ghi" {
+			t.Fatal(feedback)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback received")
+	}
+	// Posted to the callback, the feedback is neither served through the
+	// API nor kept once queued.
+	entries, err := s.feedbackStore.Read("", 10)
+	if err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+	s.callback.flushAll()
+	entries, err = s.callback.store.Read("", 10)
+	if err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+}
+
+func TestFeedbackCallbackReplay(t *testing.T) {
+	received := make(chan []tokenFeedback, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			Feedback []tokenFeedback `json:"feedback"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Error(err)
+		}
+		received <- data.Feedback
+	}))
+	defer upstream.Close()
+
+	// Feedback left unacknowledged by a previous run, the second entry
+	// being of a service no longer posted.
+	qf := disk.NewQueueFactory(t.TempDir())
+	store, err := qf.NewFeedbackStore("callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append([]byte(`{"service": "apns", "token": "abc", "reason": "invalid"}`))
+	store.Append([]byte(`{"service": "fcm", "token": "def", "reason": "invalid"}`))
+
+	s, err := NewServer("", qf, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh, _ := webhook.NewWebhookWithConfig(webhook.Config{ID: "feedback-callback"}, slog.Default())
+	err = s.SetFeedbackCallback(wh, FeedbackCallbackConfig{
+		ServiceURLs:   map[string]string{"apns": upstream.URL},
+		BatchInterval: time.Minute,
+	}, services.PumpConfig{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.callback.shutdown(context.Background())
+	s.callback.flushAll()
+
+	select {
+	case feedback := <-received:
+		if len(feedback) != 1 || feedback[0].Token != "abc" {
+			t.Fatal(feedback)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback received")
+	}
+	feedback, err := s.readFeedback("", 10)
+	if err != nil || len(feedback) != 1 || feedback[0].Token != "def" {
+		t.Fatal(feedback, err)
+	}
+	entries, err := s.callback.store.Read("", 10)
+	if err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+}
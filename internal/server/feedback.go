@@ -1,50 +1,220 @@
 package server
 
 import (
+	"codeberg.org/pennersr/shove/internal/queue"
 	"encoding/json"
+	"errors"
 	"golang.org/x/exp/slog"
 	"net/http"
+	"strconv"
 )
 
 type tokenFeedback struct {
+	ID          string `json:"id,omitempty"`
 	Service     string `json:"service"`
 	Token       string `json:"token"`
 	Replacement string `json:"replacement_token,omitempty"`
 	Reason      string `json:"reason"`
 }
 
+// reasonExpired is the reason of the feedback on expired messages, which is
+// served apart from the token feedback, so that consumers do not mistake the
+// tokens for invalid ones.
+const reasonExpired = "expired"
+
+// feedbackPage is the feedback as served, the feedback on expired messages
+// being kept apart.
+type feedbackPage struct {
+	Feedback []tokenFeedback `json:"feedback"`
+	Expired  []tokenFeedback `json:"expired,omitempty"`
+}
+
+func newFeedbackPage(feedback []tokenFeedback) (page feedbackPage) {
+	page.Feedback = make([]tokenFeedback, 0, len(feedback))
+	for _, fb := range feedback {
+		if fb.Reason == reasonExpired {
+			page.Expired = append(page.Expired, fb)
+		} else {
+			page.Feedback = append(page.Feedback, fb)
+		}
+	}
+	return
+}
+
+// event returns the type of the server-sent event of the feedback.
+func (fb tokenFeedback) event() string {
+	if fb.Reason == reasonExpired {
+		return "expired"
+	}
+	return "feedback"
+}
+
+const (
+	defaultFeedbackCount = 100
+	maxFeedbackCount     = 1000
+)
+
+func (s *Server) addFeedback(fb tokenFeedback) {
+	feedbackCounter.WithLabelValues(fb.Service, fb.Reason).Inc()
+	if s.callback != nil && s.callback.covers(fb.Service) {
+		if err := s.callback.add(fb); err != nil {
+			slog.Error("Unable to store feedback", "error", err)
+		}
+		return
+	}
+	s.storeFeedback(fb)
+}
+
+// storeFeedback adds the feedback to the store served by the API.
+func (s *Server) storeFeedback(fb tokenFeedback) {
+	j, err := json.Marshal(fb)
+	if err != nil {
+		slog.Error("Unable to encode feedback", "error", err)
+		return
+	}
+	if _, err = s.feedbackStore.Append(j); err != nil {
+		slog.Error("Unable to store feedback", "error", err)
+		return
+	}
+	s.feedbackNotifier.notify()
+}
+
+// readFeedback returns the feedback following the cursor.
+func (s *Server) readFeedback(cursor string, count int) (feedback []tokenFeedback, err error) {
+	entries, err := s.feedbackStore.Read(cursor, count)
+	if err != nil {
+		return
+	}
+	return decodeFeedback(entries)
+}
+
+func decodeFeedback(entries []queue.FeedbackEntry) (feedback []tokenFeedback, err error) {
+	feedback = make([]tokenFeedback, 0, len(entries))
+	for _, entry := range entries {
+		var fb tokenFeedback
+		if err = json.Unmarshal(entry.Data, &fb); err != nil {
+			return
+		}
+		fb.ID = entry.ID
+		feedback = append(feedback, fb)
+	}
+	return
+}
+
+func feedbackError(w http.ResponseWriter, err error) {
+	if errors.Is(err, queue.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), 500)
+}
+
+// handleFeedback serves the feedback. A GET reads the feedback following the
+// cursor passed, leaving it in place until acknowledged. A POST drains all
+// feedback at once, which is kept for backwards compatibility.
 func (s *Server) handleFeedback(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+	if r.Method != "GET" && r.Method != "POST" {
 		http.Error(w, "Invalid request method.", 405)
 		return
 	}
-	s.feedbackLock.Lock()
-	j, err := json.Marshal(struct {
-		Feedback []tokenFeedback `json:"feedback"`
-	}{Feedback: s.feedback})
+	if !s.authorize(w, r, ScopeFeedback) {
+		return
+	}
+	var j []byte
+	var err error
+	if r.Method == "GET" {
+		j, err = s.readFeedbackPage(r)
+	} else {
+		j, err = s.drainFeedback()
+	}
 	if err != nil {
-		s.feedbackLock.Unlock()
-		http.Error(w, err.Error(), 500)
+		feedbackError(w, err)
 		return
 	}
-	s.feedback = make([]tokenFeedback, 0)
-	s.feedbackLock.Unlock()
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(j)
 }
 
+func (s *Server) readFeedbackPage(r *http.Request) (j []byte, err error) {
+	cursor := r.URL.Query().Get("cursor")
+	count := defaultFeedbackCount
+	if c, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && c > 0 {
+		count = min(c, maxFeedbackCount)
+	}
+	feedback, err := s.readFeedback(cursor, count)
+	if err != nil {
+		return
+	}
+	if len(feedback) > 0 {
+		cursor = feedback[len(feedback)-1].ID
+	}
+	return json.Marshal(struct {
+		feedbackPage
+		Cursor string `json:"cursor"`
+	}{feedbackPage: newFeedbackPage(feedback), Cursor: cursor})
+}
+
+func (s *Server) drainFeedback() (j []byte, err error) {
+	feedback := make([]tokenFeedback, 0)
+	cursor := ""
+	for {
+		var page []tokenFeedback
+		if page, err = s.readFeedback(cursor, maxFeedbackCount); err != nil {
+			return
+		}
+		if len(page) == 0 {
+			break
+		}
+		feedback = append(feedback, page...)
+		cursor = page[len(page)-1].ID
+	}
+	if j, err = json.Marshal(newFeedbackPage(feedback)); err != nil {
+		return
+	}
+	if cursor != "" {
+		err = s.feedbackStore.Ack(cursor)
+	}
+	return
+}
+
+// handleFeedbackAck acknowledges all feedback up to and including the cursor.
+func (s *Server) handleFeedbackAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !s.authorize(w, r, ScopeFeedback) {
+		return
+	}
+	cursor := r.FormValue("cursor")
+	if cursor == "" {
+		http.Error(w, "Missing cursor.", http.StatusBadRequest)
+		return
+	}
+	if err := s.feedbackStore.Ack(cursor); err != nil {
+		feedbackError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // TokenInvalid ...
 func (s *Server) TokenInvalid(serviceID, token string) {
-	s.feedbackLock.Lock()
-	s.feedback = append(s.feedback, tokenFeedback{serviceID, token, "", "invalid"})
-	s.feedbackLock.Unlock()
+	s.addFeedback(tokenFeedback{Service: serviceID, Token: token, Reason: "invalid"})
 	slog.Info("Invalid token", "service", serviceID, "token", token)
 }
 
 // ReplaceToken ...
 func (s *Server) ReplaceToken(serviceID, token, replacement string) {
-	s.feedbackLock.Lock()
-	s.feedback = append(s.feedback, tokenFeedback{serviceID, token, replacement, "replaced"})
-	s.feedbackLock.Unlock()
+	s.addFeedback(tokenFeedback{Service: serviceID, Token: token, Replacement: replacement, Reason: "replaced"})
 	slog.Info("Token replaced", "service", serviceID)
 }
+
+// MessageExpired ...
+func (s *Server) MessageExpired(serviceID, token string) {
+	pushExpiredCounter.WithLabelValues(serviceID).Inc()
+	if !s.config.ExpiredFeedback || token == "" {
+		return
+	}
+	s.addFeedback(tokenFeedback{Service: serviceID, Token: token, Reason: reasonExpired})
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+)
+
+func TestExpiredFeedback(t *testing.T) {
+	s, err := NewServer("", memory.MemoryQueueFactory{}, Config{ExpiredFeedback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TokenInvalid("apns", "abc")
+	s.MessageExpired("apns", "def")
+
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/feedback", nil))
+	var page struct {
+		Feedback []tokenFeedback `json:"feedback"`
+		Expired  []tokenFeedback `json:"expired"`
+		Cursor   string          `json:"cursor"`
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	// Consumers only reading the token feedback do not see the expired
+	// message.
+	if len(page.Feedback) != 1 || page.Feedback[0].Token != "abc" {
+		t.Fatal(page.Feedback)
+	}
+	if len(page.Expired) != 1 || page.Expired[0].Token != "def" || page.Cursor != page.Expired[0].ID {
+		t.Fatal(page.Expired, page.Cursor)
+	}
+}
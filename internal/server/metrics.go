@@ -1,8 +1,13 @@
 package server
 
 import (
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/services"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/exp/slog"
+	"net/http"
 	"time"
 )
 
@@ -20,14 +25,233 @@ var (
 	}, []string{
 		"service",
 	})
+
+	apiRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_api_requests_total",
+		Help: "The total number of API requests, per API key",
+	}, []string{
+		"key",
+		"endpoint",
+		"code",
+	})
+
+	pushExpiredCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_push_expired_total",
+		Help: "The total number of push notifications dropped as they expired",
+	}, []string{
+		"service",
+	})
+
+	pushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shove_push_duration_seconds",
+		Help:    "The time it took to push notifications upstream",
+		Buckets: prometheus.DefBuckets,
+	}, []string{
+		"service",
+		"outcome",
+	})
+
+	queueDepthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shove_queue_depth",
+		Help: "The number of messages queued, per state",
+	}, []string{
+		"service",
+		"state",
+	})
+
+	squashedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_squashed_total",
+		Help: "The total number of messages squashed as rate limits were exceeded",
+	}, []string{
+		"service",
+	})
+
+	squashPendingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shove_squash_batches_pending",
+		Help: "The number of batches of squashed messages waiting to be pushed",
+	}, []string{
+		"service",
+	})
+
+	squashBatchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shove_squash_batch_size",
+		Help:    "The number of messages per batch of squashed messages pushed",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{
+		"service",
+	})
+
+	backoffCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_backoff_total",
+		Help: "The total number of times pushing backed off after a failure",
+	}, []string{
+		"service",
+	})
+
+	backoffSecondsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_backoff_seconds_total",
+		Help: "The total time spent backing off after failures",
+	}, []string{
+		"service",
+	})
+
+	throttleCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_throttle_total",
+		Help: "The total number of pushes held back by the rate limit",
+	}, []string{
+		"service",
+	})
+
+	throttleSecondsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_throttle_seconds_total",
+		Help: "The total time spent waiting for the rate limit",
+	}, []string{
+		"service",
+	})
+
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shove_breaker_state",
+		Help: "The state of the circuit breaker, 1 for the current state and 0 otherwise",
+	}, []string{
+		"service",
+		"state",
+	})
+
+	breakerTripsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_breaker_trips_total",
+		Help: "The total number of times the circuit breaker opened",
+	}, []string{
+		"service",
+	})
+
+	squashTrackedKeysGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shove_squash_tracked_keys",
+		Help: "The number of squash keys of which the push rate is kept track of in memory",
+	}, []string{
+		"service",
+	})
+
+	workersGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shove_workers",
+		Help: "The number of workers of the service",
+	}, []string{
+		"service",
+	})
+
+	pausedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shove_paused",
+		Help: "Whether or not the service is paused through the admin API",
+	}, []string{
+		"service",
+	})
+
+	feedbackCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shove_feedback_total",
+		Help: "The total number of feedback entries, per reason",
+	}, []string{
+		"service",
+		"reason",
+	})
 )
 
 // CountPush ...
 func (s *Server) CountPush(serviceID string, success bool, duration time.Duration) {
+	outcome := "success"
 	if success {
 		pushSuccessCounter.WithLabelValues(serviceID).Inc()
 	} else {
 		pushErrorCounter.WithLabelValues(serviceID).Inc()
+		outcome = "error"
+	}
+	pushDuration.WithLabelValues(serviceID, outcome).Observe(duration.Seconds())
+}
+
+// CountBackoff ...
+func (s *Server) CountBackoff(serviceID string, duration time.Duration) {
+	backoffCounter.WithLabelValues(serviceID).Inc()
+	backoffSecondsCounter.WithLabelValues(serviceID).Add(duration.Seconds())
+}
+
+// CountThrottle ...
+func (s *Server) CountThrottle(serviceID string, duration time.Duration) {
+	throttleCounter.WithLabelValues(serviceID).Inc()
+	throttleSecondsCounter.WithLabelValues(serviceID).Add(duration.Seconds())
+}
+
+// CountSquash ...
+func (s *Server) CountSquash(serviceID string, pendingBatches int) {
+	squashedCounter.WithLabelValues(serviceID).Inc()
+	squashPendingGauge.WithLabelValues(serviceID).Set(float64(pendingBatches))
+}
+
+// CountSquashBatch ...
+func (s *Server) CountSquashBatch(serviceID string, size int, pendingBatches int) {
+	squashBatchSize.WithLabelValues(serviceID).Observe(float64(size))
+	squashPendingGauge.WithLabelValues(serviceID).Set(float64(pendingBatches))
+}
+
+// BreakerStateChanged ...
+func (s *Server) BreakerStateChanged(serviceID string, state services.BreakerState) {
+	switch state {
+	case services.BreakerOpen:
+		breakerTripsCounter.WithLabelValues(serviceID).Inc()
+		slog.Warn("Circuit breaker opened, suspending pushes", "service", serviceID)
+	case services.BreakerHalfOpen:
+		slog.Info("Circuit breaker half-open, probing", "service", serviceID)
+	case services.BreakerClosed:
+		slog.Info("Circuit breaker closed, resuming pushes", "service", serviceID)
 	}
+}
 
+// updateQueueMetrics sets the queue depth and breaker state gauges, and is
+// called right before the metrics are scraped.
+func (s *Server) updateQueueMetrics() {
+	for id, w := range s.allWorkers() {
+		s.updateQueueDepth(id, w)
+		s.updatePumpState(id, w)
+	}
+	if s.callback != nil {
+		s.updateQueueDepth(s.callback.worker.service.ID(), s.callback.worker)
+		s.updatePumpState(s.callback.worker.service.ID(), s.callback.worker)
+	}
+}
+
+func (s *Server) updatePumpState(id string, w *worker) {
+	current := w.pump.BreakerStatus().State
+	for _, state := range []services.BreakerState{services.BreakerClosed, services.BreakerOpen, services.BreakerHalfOpen} {
+		value := 0.
+		if state == current {
+			value = 1
+		}
+		breakerStateGauge.WithLabelValues(id, string(state)).Set(value)
+	}
+	workersGauge.WithLabelValues(id).Set(float64(w.pump.Workers()))
+	paused := 0.
+	if w.pump.Paused() {
+		paused = 1
+	}
+	pausedGauge.WithLabelValues(id).Set(paused)
+	if kc, ok := w.squash.(queue.KeyCounter); ok {
+		squashTrackedKeysGauge.WithLabelValues(id).Set(float64(kc.TrackedKeys()))
+	}
+}
+
+func (s *Server) updateQueueDepth(id string, w *worker) {
+	depth, err := w.queue.Depth()
+	if err != nil {
+		slog.Error("Unable to determine queue depth", "service", id, "error", err)
+		return
+	}
+	queueDepthGauge.WithLabelValues(id, "waiting").Set(float64(depth.Waiting))
+	queueDepthGauge.WithLabelValues(id, "in-flight").Set(float64(depth.InFlight))
+	queueDepthGauge.WithLabelValues(id, "scheduled").Set(float64(depth.Scheduled))
+	queueDepthGauge.WithLabelValues(id, "dead").Set(float64(depth.Dead))
+}
+
+func (s *Server) metricsHandler() http.Handler {
+	h := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.updateQueueMetrics()
+		h.ServeHTTP(w, r)
+	})
 }
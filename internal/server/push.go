@@ -1,7 +1,10 @@
 package server
 
 import (
-	"fmt"
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/services"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -9,7 +12,14 @@ import (
 
 func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
 	service := strings.TrimPrefix(r.URL.Path, "/api/push/")
-	wrk, ok := s.workers[service]
+	if strings.HasSuffix(service, "/batch") {
+		s.handleBatchPush(w, r, strings.TrimSuffix(service, "/batch"))
+		return
+	}
+	if !s.authorize(w, r, PushScope(service)) {
+		return
+	}
+	wrk, ok := s.lookupWorker(service)
 	if !ok {
 		http.NotFound(w, r)
 		return
@@ -25,11 +35,31 @@ func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = wrk.push(body)
+	ctx, span := startPushSpan(r, service)
+	id, err := wrk.push(ctx, body, r.Header.Get("Idempotency-Key"), s.config.IdempotencyWindow)
+	services.EndSpan(span, err)
+	if errors.Is(err, queue.ErrDuplicate) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, queue.ErrFull) {
+		// Let the producer back off.
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	j, err := json.Marshal(struct {
+		ID string `json:"id"`
+	}{ID: id})
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
-	fmt.Fprintf(w, "OK")
+	w.Write(j)
 }
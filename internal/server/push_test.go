@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+	"codeberg.org/pennersr/shove/internal/services"
+	"codeberg.org/pennersr/shove/internal/services/webhook"
+	"golang.org/x/exp/slog"
+)
+
+// deliveringQueueFactory creates queues that return from queueing a message
+// only once it has been delivered.
+type deliveringQueueFactory struct {
+	memory.MemoryQueueFactory
+	delivered func(id string)
+}
+
+func (qf deliveringQueueFactory) NewQueue(id string) (queue.Queue, error) {
+	q, err := qf.MemoryQueueFactory.NewQueue(id)
+	return deliveringQueue{wrappedQueue: q, delivered: qf.delivered}, err
+}
+
+// wrappedQueue names the queue embedded by deliveringQueue, which overrides
+// its Queue method.
+type wrappedQueue = queue.Queue
+
+type deliveringQueue struct {
+	wrappedQueue
+	delivered func(id string)
+}
+
+func (q deliveringQueue) Queue(msg []byte) (err error) {
+	if err = q.wrappedQueue.Queue(msg); err == nil {
+		env, _ := services.ParseEnvelope(msg)
+		q.delivered(env.MessageID)
+	}
+	return
+}
+
+func TestQueuedStatusNotOverwritten(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer upstream.Close()
+	var s *Server
+	status := func(id string) services.MessageState {
+		var ms services.MessageStatus
+		data, _ := s.statusStore.GetStatus(id)
+		json.Unmarshal(data, &ms)
+		return ms.State
+	}
+	qf := deliveringQueueFactory{delivered: func(id string) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if status(id) == services.MessageDelivered {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("not delivered", id)
+	}}
+	s, err := NewServer("", qf, Config{StatusRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	wh, _ := webhook.NewWebhookWithConfig(webhook.Config{ID: "hooks"}, slog.Default())
+	if err = s.AddService(wh, services.PumpConfig{Workers: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"url": "` + upstream.URL + `", "body": ""}`
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/push/hooks", strings.NewReader(body)))
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(w.Body.String())
+	}
+	// Delivered before the push request finished, the status does not go
+	// back to queued.
+	if state := status(resp.ID); state != services.MessageDelivered {
+		t.Fatal(state)
+	}
+}
@@ -4,40 +4,107 @@ import (
 	"codeberg.org/pennersr/shove/internal/queue"
 	"codeberg.org/pennersr/shove/internal/services"
 	"context"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"golang.org/x/exp/slog"
 	"net/http"
 	"sync"
+	"time"
 )
 
+// Config ...
+type Config struct {
+	// ExpiredFeedback enables feedback on messages that expired before
+	// they could be pushed.
+	ExpiredFeedback bool
+	// IdempotencyWindow is the period within which messages carrying the
+	// same idempotency key are considered duplicates. Zero disables
+	// deduplication.
+	IdempotencyWindow time.Duration
+	// StatusRetention is the period for which the status of messages is
+	// retained. Zero disables keeping track of statuses.
+	StatusRetention time.Duration
+	// APIKeys are the keys granting access to the API. If none are given,
+	// the API is open to anyone.
+	APIKeys []APIKey
+	// DrainTimeout bounds the time given to finish pushing when a service
+	// is removed or replaced, defaulting to defaultDrainTimeout.
+	DrainTimeout time.Duration
+}
+
+// defaultDrainTimeout is the drain timeout unless configured otherwise.
+const defaultDrainTimeout = 30 * time.Second
+
 // Server ...
 type Server struct {
+	config       Config
 	server       *http.Server
 	shuttingDown bool
 	queueFactory queue.QueueFactory
+	statusStore  queue.StatusStore
+	apiKeys      map[[sha256.Size]byte]*APIKey
+	workersLock  sync.RWMutex
 	workers      map[string]*worker
-	feedbackLock sync.Mutex
-	feedback     []tokenFeedback
+	// removed holds the workers of removed services, keeping their queues
+	// for when the service is added again.
+	removed       map[string]*worker
+	feedbackStore queue.FeedbackStore
+	callback      *feedbackCallback
+	// feedbackNotifier wakes up feedback streams, which are ended once
+	// closing is closed.
+	feedbackNotifier feedbackNotifier
+	closing          chan struct{}
+	closeOnce        sync.Once
+	reload           func() error
 }
 
 // NewServer ...
-func NewServer(addr string, qf queue.QueueFactory) (s *Server) {
+func NewServer(addr string, qf queue.QueueFactory, config Config) (s *Server, err error) {
 	mux := http.NewServeMux()
-
-	h := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+	statusStore, err := qf.NewStatusStore()
+	if err != nil {
+		return
+	}
+	feedbackStore, err := qf.NewFeedbackStore("")
+	if err != nil {
+		return
 	}
+
 	s = &Server{
-		server:       h,
-		queueFactory: qf,
-		workers:      make(map[string]*worker),
-		feedback:     make([]tokenFeedback, 0),
+		config:        config,
+		queueFactory:  qf,
+		statusStore:   statusStore,
+		apiKeys:       make(map[[sha256.Size]byte]*APIKey),
+		workers:       make(map[string]*worker),
+		removed:       make(map[string]*worker),
+		feedbackStore: feedbackStore,
+		closing:       make(chan struct{}),
+	}
+	for i := range config.APIKeys {
+		key := &config.APIKeys[i]
+		s.apiKeys[tokenDigest(key.Token)] = key
 	}
+	s.server = &http.Server{
+		Addr:    addr,
+		Handler: s.authenticate(mux),
+	}
+	// Streams never go idle, end them so that shutting down does not hang.
+	s.server.RegisterOnShutdown(func() {
+		s.closeOnce.Do(func() {
+			close(s.closing)
+		})
+	})
 	mux.HandleFunc("/api/push/", s.handlePush)
 	mux.HandleFunc("/api/feedback", s.handleFeedback)
-	mux.Handle("/metrics", promhttp.Handler())
-	return s
+	mux.HandleFunc("/api/feedback/ack", s.handleFeedbackAck)
+	mux.HandleFunc("/api/feedback/stream", s.handleFeedbackStream)
+	mux.HandleFunc("/api/messages/", s.handleMessageStatus)
+	mux.Handle("/api/admin/status", s.authorized(ScopeAdmin, http.HandlerFunc(s.handleAdminStatus)))
+	mux.Handle("/api/admin/reload", s.authorized(ScopeAdmin, http.HandlerFunc(s.handleAdminReload)))
+	mux.Handle("/api/admin/services/", s.authorized(ScopeAdmin, http.HandlerFunc(s.handleAdminService)))
+	mux.Handle("/metrics", s.authorized(ScopeMetrics, s.metricsHandler()))
+	return
 }
 
 // Serve ...
@@ -50,36 +117,172 @@ func (s *Server) Serve() (err error) {
 	return
 }
 
-// Shutdown ...
+// Shutdown stops accepting requests, and drains the services: pushes in
+// progress are finished and pending squash batches are flushed, until the
+// context is done. The queues are shut down last, leaving the messages not
+// pushed by then in flight (persisted queues pick them up again on restart).
 func (s *Server) Shutdown(ctx context.Context) (err error) {
 	s.shuttingDown = true
-	s.server.Shutdown(ctx)
 	if err = s.server.Shutdown(ctx); err != nil {
 		slog.Error("Shutting down Shove server", "error", err)
-		return
+	} else {
+		slog.Info("Shove server stopped")
 	}
-	slog.Info("Shove server stopped")
-	for _, w := range s.workers {
-		err = w.shutdown()
-		if err != nil {
-			return
-		}
+	workers := s.allWorkers()
+	var wg sync.WaitGroup
+	errs := make([]error, len(workers))
+	i := 0
+	for _, w := range workers {
+		wg.Add(1)
+		go func(i int, w *worker) {
+			defer wg.Done()
+			errs[i] = w.shutdown(ctx)
+		}(i, w)
+		i++
 	}
-	return
+	wg.Wait()
+	s.workersLock.RLock()
+	for _, w := range s.removed {
+		errs = append(errs, w.queue.Shutdown())
+	}
+	s.workersLock.RUnlock()
+	if s.callback != nil {
+		// Last, as the services above report feedback to it.
+		errs = append(errs, s.callback.shutdown(ctx))
+	}
+	return errors.Join(append(errs, err)...)
 }
 
 // AddService ...
-func (s *Server) AddService(pp services.PushService, workers int, squash services.SquashConfig) (err error) {
+func (s *Server) AddService(pp services.PushService, config services.PumpConfig) (err error) {
 	slog.Info("Initializing service", "service", pp)
-	q, err := s.queueFactory.NewQueue(pp.ID())
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+	_, ok := s.workers[pp.ID()]
+	if ok || (s.callback != nil && s.callback.worker.service.ID() == pp.ID()) {
+		err = fmt.Errorf("duplicate service ID %q", pp.ID())
+		return
+	}
+	w, err := s.newWorker(pp, config)
 	if err != nil {
 		return
 	}
-	w, err := newWorker(pp, q)
+	go w.serve()
+	s.workers[pp.ID()] = w
+	return
+}
+
+// RemoveService stops the service, waiting for the pushes in progress to
+// finish. Messages still queued are kept, and picked up again once a service
+// with the same ID is added.
+func (s *Server) RemoveService(id string) (err error) {
+	s.workersLock.Lock()
+	w, ok := s.workers[id]
+	delete(s.workers, id)
+	if ok {
+		s.removed[id] = w
+	}
+	s.workersLock.Unlock()
+	if !ok {
+		err = fmt.Errorf("unknown service ID %q", id)
+		return
+	}
+	slog.Info("Removing service", "service", w.service)
+	ctx, cancel := s.drainContext()
+	defer cancel()
+	if w.stop(ctx, false) != nil {
+		slog.Warn("Drain deadline exceeded, leaving messages in flight", "service", id)
+	}
+	return
+}
+
+// ReplaceService swaps the running service having the same ID for the given
+// one, e.g. as its configuration or credentials changed. Only the pump of the
+// service is restarted, the queue is left untouched. Pushes in progress are
+// finished before the new service starts pushing, using new clients.
+func (s *Server) ReplaceService(pp services.PushService, config services.PumpConfig) (err error) {
+	s.workersLock.Lock()
+	old, ok := s.workers[pp.ID()]
+	if !ok {
+		s.workersLock.Unlock()
+		err = fmt.Errorf("unknown service ID %q", pp.ID())
+		return
+	}
+	slog.Info("Replacing service", "service", pp)
+	w, err := newWorker(pp, config, old.queue, old.dedup, old.squash, s)
 	if err != nil {
+		s.workersLock.Unlock()
 		return
 	}
-	go w.serve(workers, squash, s)
+	if old.pump.Paused() {
+		// Paused through the admin API, which a reload does not undo.
+		w.pump.Pause()
+	}
 	s.workers[pp.ID()] = w
+	s.workersLock.Unlock()
+	// The pending squash batches are left for the new worker, which shares
+	// the squash store.
+	ctx, cancel := s.drainContext()
+	defer cancel()
+	if old.stop(ctx, true) != nil {
+		slog.Warn("Drain deadline exceeded, starting alongside pushes in progress", "service", pp.ID())
+	}
+	go w.serve()
 	return
 }
+
+// drainContext returns the context bounding the draining of a service that is
+// removed or replaced.
+func (s *Server) drainContext() (context.Context, context.CancelFunc) {
+	timeout := s.config.DrainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// SetReloader sets the function reloading the configuration, as triggered
+// through the admin API.
+func (s *Server) SetReloader(reload func() error) {
+	s.reload = reload
+}
+
+func (s *Server) lookupWorker(id string) (w *worker, ok bool) {
+	s.workersLock.RLock()
+	defer s.workersLock.RUnlock()
+	w, ok = s.workers[id]
+	return
+}
+
+// allWorkers returns a snapshot of the workers per service ID.
+func (s *Server) allWorkers() map[string]*worker {
+	s.workersLock.RLock()
+	defer s.workersLock.RUnlock()
+	workers := make(map[string]*worker, len(s.workers))
+	for id, w := range s.workers {
+		workers[id] = w
+	}
+	return workers
+}
+
+// newWorker sets up the worker of a service, picking up the queue of a
+// service previously removed. The caller holds the workers lock.
+func (s *Server) newWorker(pp services.PushService, config services.PumpConfig) (w *worker, err error) {
+	if old, ok := s.removed[pp.ID()]; ok {
+		delete(s.removed, pp.ID())
+		return newWorker(pp, config, old.queue, old.dedup, old.squash, s)
+	}
+	q, err := s.queueFactory.NewQueue(pp.ID())
+	if err != nil {
+		return
+	}
+	dedup, err := s.queueFactory.NewDeduplicator(pp.ID())
+	if err != nil {
+		return
+	}
+	squash, err := s.queueFactory.NewSquashStore(pp.ID())
+	if err != nil {
+		return
+	}
+	return newWorker(pp, config, q, dedup, squash, s)
+}
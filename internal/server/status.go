@@ -0,0 +1,59 @@
+package server
+
+import (
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/services"
+	"encoding/json"
+	"errors"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"strings"
+)
+
+func (s *Server) handleMessageStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !s.allowed(r, (*APIKey).allowsAnyPush) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/messages/")
+	status, err := s.statusStore.GetStatus(id)
+	if errors.Is(err, queue.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var ms services.MessageStatus
+	if err = json.Unmarshal(status, &ms); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !s.allowed(r, func(key *APIKey) bool { return key.allows(PushScope(ms.Service)) }) {
+		// Not telling messages of other services apart from unknown ones.
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(status)
+}
+
+// TrackMessage ...
+func (s *Server) TrackMessage(status services.MessageStatus) {
+	if s.config.StatusRetention <= 0 {
+		return
+	}
+	j, err := json.Marshal(status)
+	if err != nil {
+		slog.Error("Unable to encode message status", "error", err)
+		return
+	}
+	if err = s.statusStore.SetStatus(status.ID, j, s.config.StatusRetention); err != nil {
+		slog.Error("Unable to store message status", "error", err)
+	}
+}
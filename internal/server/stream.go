@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// streamPollInterval is the interval at which streams check for feedback
+	// stored by other Shove instances.
+	streamPollInterval = time.Second
+	streamKeepAlive    = 15 * time.Second
+)
+
+// feedbackNotifier wakes up the streams once feedback is added.
+type feedbackNotifier struct {
+	lock        sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+func (fn *feedbackNotifier) subscribe() chan struct{} {
+	fn.lock.Lock()
+	defer fn.lock.Unlock()
+	if fn.subscribers == nil {
+		fn.subscribers = make(map[chan struct{}]struct{})
+	}
+	ch := make(chan struct{}, 1)
+	fn.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (fn *feedbackNotifier) unsubscribe(ch chan struct{}) {
+	fn.lock.Lock()
+	defer fn.lock.Unlock()
+	delete(fn.subscribers, ch)
+}
+
+func (fn *feedbackNotifier) notify() {
+	fn.lock.Lock()
+	defer fn.lock.Unlock()
+	for ch := range fn.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handleFeedbackStream streams feedback as server-sent events. Reconnecting
+// clients resume following the Last-Event-ID passed, new clients only receive
+// feedback added from then on, unless a cursor is passed. Every stream
+// receives all feedback, acknowledging is left to the regular consumer.
+func (s *Server) handleFeedbackStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !s.authorize(w, r, ScopeFeedback) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported.", 500)
+		return
+	}
+	sub := s.feedbackNotifier.subscribe()
+	defer s.feedbackNotifier.unsubscribe(sub)
+
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("cursor")
+	}
+	var err error
+	if cursor == "" {
+		if cursor, err = s.feedbackStore.Last(); err != nil {
+			feedbackError(w, err)
+			return
+		}
+	}
+	feedback, err := s.readFeedback(cursor, maxFeedbackCount)
+	if err != nil {
+		feedbackError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
+	lastWrite := time.Now()
+	for {
+		for _, fb := range feedback {
+			j, err := json.Marshal(fb)
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", fb.ID, fb.event(), j); err != nil {
+				return
+			}
+			cursor = fb.ID
+		}
+		if len(feedback) > 0 {
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+		if len(feedback) < maxFeedbackCount {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-s.closing:
+				return
+			case <-sub:
+			case <-poll.C:
+				if time.Since(lastWrite) >= streamKeepAlive {
+					if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+						return
+					}
+					flusher.Flush()
+					lastWrite = time.Now()
+				}
+			}
+		}
+		if feedback, err = s.readFeedback(cursor, maxFeedbackCount); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+)
+
+// readEventIDs reads the IDs of the first n events of the stream.
+func readEventIDs(t *testing.T, url, lastEventID string, n int, during func()) (ids []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url+"/api/feedback/stream", nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal(resp.Header)
+	}
+	during()
+	scanner := bufio.NewScanner(resp.Body)
+	for len(ids) < n && scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+func TestFeedbackStream(t *testing.T) {
+	s, err := NewServer("", memory.MemoryQueueFactory{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.server.Handler)
+	defer ts.Close()
+
+	s.TokenInvalid("apns", "old")
+	// New streams only receive new feedback.
+	ids := readEventIDs(t, ts.URL, "", 2, func() {
+		s.TokenInvalid("apns", "a")
+		s.TokenInvalid("apns", "b")
+	})
+	if len(ids) != 2 || ids[0] != "2" || ids[1] != "3" {
+		t.Fatal(ids)
+	}
+	// Reconnecting resumes following the last event seen.
+	ids = readEventIDs(t, ts.URL, "2", 1, func() {})
+	if len(ids) != 1 || ids[0] != "3" {
+		t.Fatal(ids)
+	}
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"codeberg.org/pennersr/shove/internal/services"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer(services.TracerName)
+
+// startPushSpan starts the span covering the intake of pushed messages,
+// continuing the trace of the producer if the request carries one.
+func startPushSpan(r *http.Request, service string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, "push "+service,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("shove.service", service)),
+	)
+}
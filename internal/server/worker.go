@@ -5,48 +5,204 @@ import (
 	"codeberg.org/pennersr/shove/internal/services"
 	"context"
 	"golang.org/x/exp/slog"
+	"time"
 )
 
 type worker struct {
 	queue    queue.Queue
+	dedup    queue.Deduplicator
+	squash   queue.SquashStore
 	service  services.PushService
+	pump     *services.Pump
+	fc       services.FeedbackCollector
 	ctx      context.Context
 	cancel   context.CancelFunc
 	finished chan (bool)
 }
 
-func newWorker(pp services.PushService, queue queue.Queue) (w *worker, err error) {
+func newWorker(pp services.PushService, config services.PumpConfig, queue queue.Queue, dedup queue.Deduplicator, squash queue.SquashStore, fc services.FeedbackCollector) (w *worker, err error) {
+	config.Squash.Store = squash
 	w = &worker{
 		queue:    queue,
+		dedup:    dedup,
+		squash:   squash,
 		service:  pp,
-		finished: make(chan bool),
+		pump:     services.NewPump(config, pp),
+		fc:       fc,
+		finished: make(chan bool, 1),
 	}
 	w.ctx, w.cancel = context.WithCancel(context.Background())
 	return
 }
 
-func (w *worker) push(msg []byte) (err error) {
+// preparedMessage is a message that has been validated and assigned an ID,
+// ready to be queued.
+type preparedMessage struct {
+	id  string
+	msg []byte
+	env services.Envelope
+	key string
+}
+
+// prepare readies the message for queueing. Messages carrying an idempotency
+// key, either passed explicitly or through the `id` envelope field, are
+// accepted only once within the window. The trace context, if any, is stored
+// in the envelope so that the delivery of the message joins the trace.
+func (w *worker) prepare(ctx context.Context, msg []byte, key string, window time.Duration, now time.Time) (pm preparedMessage, err error) {
 	if err = w.service.Validate(msg); err != nil {
 		return
 	}
-	err = w.queue.Queue(msg)
+	msg, env, err := services.PrepareMessage(msg, now)
+	if err != nil {
+		return
+	}
+	if key == "" {
+		key = env.ID
+	}
+	if key != "" && window > 0 {
+		var claimed bool
+		if claimed, err = w.dedup.Claim(key, window); err != nil {
+			return
+		}
+		if !claimed {
+			err = queue.ErrDuplicate
+			return
+		}
+		pm.key = key
+		defer func() {
+			if err != nil {
+				w.release(pm)
+			}
+		}()
+	}
+	if pm.id, err = services.NewMessageID(); err != nil {
+		return
+	}
+	if pm.msg, err = services.AssignMessageID(msg, pm.id); err != nil {
+		return
+	}
+	if tc := services.InjectTraceContext(ctx); len(tc) > 0 {
+		if pm.msg, err = services.AssignTraceContext(pm.msg, tc); err != nil {
+			return
+		}
+	}
+	pm.env = env
+	return
+}
+
+// release gives up the idempotency key claimed by a message that could not be
+// queued after all.
+func (w *worker) release(pm preparedMessage) {
+	if pm.key != "" {
+		w.dedup.Release(pm.key)
+	}
+}
+
+// queueAt queues the message, deferring it in case it is not due yet.
+func (w *worker) queueAt(pm preparedMessage, now time.Time) (err error) {
+	if !pm.env.Due(now) {
+		return w.queue.QueueAt(pm.msg, *pm.env.SendAt)
+	}
+	return w.queue.Queue(pm.msg)
+}
+
+// queued records the message as queued. This is done before queueing it, as
+// a worker may pick it up (and record its next state) right away. Should
+// queueing fail, the ID is never handed out.
+func (w *worker) queued(pm preparedMessage, now time.Time) {
+	w.fc.TrackMessage(services.MessageStatus{
+		ID:        pm.id,
+		Service:   w.service.ID(),
+		State:     services.MessageQueued,
+		UpdatedAt: now,
+	})
+}
+
+// push queues the message.
+func (w *worker) push(ctx context.Context, msg []byte, key string, window time.Duration) (id string, err error) {
+	now := time.Now()
+	pm, err := w.prepare(ctx, msg, key, window, now)
+	if err != nil {
+		return
+	}
+	w.queued(pm, now)
+	if err = w.queueAt(pm, now); err != nil {
+		w.release(pm)
+		return
+	}
+	id = pm.id
 	return
 }
 
-func (w *worker) serve(workers int, squash services.SquashConfig, fc services.FeedbackCollector) {
-	pump := services.NewPump(workers, squash, w.service)
-	err := pump.Serve(w.ctx, w.queue, fc)
+// pushBatch queues the valid messages of the batch. The messages that are due
+// are queued in one go, the outcome is reported per message.
+func (w *worker) pushBatch(ctx context.Context, msgs [][]byte, window time.Duration) (results []batchResult) {
+	now := time.Now()
+	results = make([]batchResult, len(msgs))
+	var batch [][]byte
+	var batched []int
+	pms := make([]preparedMessage, len(msgs))
+	for i, msg := range msgs {
+		pm, err := w.prepare(ctx, msg, "", window, now)
+		if err != nil {
+			results[i] = rejected(err)
+			continue
+		}
+		w.queued(pm, now)
+		if !pm.env.Due(now) {
+			if err = w.queueAt(pm, now); err != nil {
+				w.release(pm)
+				results[i] = rejected(err)
+				continue
+			}
+			results[i] = accepted(pm.id)
+			continue
+		}
+		pms[i] = pm
+		batch = append(batch, pm.msg)
+		batched = append(batched, i)
+	}
+	err := w.queue.QueueBatch(batch)
+	for _, i := range batched {
+		if err != nil {
+			w.release(pms[i])
+			results[i] = rejected(err)
+		} else {
+			results[i] = accepted(pms[i].id)
+		}
+	}
+	return
+}
+
+func (w *worker) serve() {
+	err := w.pump.Serve(w.ctx, w.queue, w.fc)
 	if err != nil {
 		slog.Error("Serve failed", "error", err)
 	}
 	w.finished <- true
 }
 
-func (w *worker) shutdown() (err error) {
-	if err = w.queue.Shutdown(); err != nil {
-		return
+// stop drains the pump, waiting for the pushes in progress to finish and the
+// pending squash batches to be flushed, until the context is done. When
+// handing over to another worker, the batches are left in the squash store
+// instead. The queue is left as is.
+func (w *worker) stop(ctx context.Context, handover bool) (err error) {
+	if handover {
+		err = w.pump.Handover(ctx)
+	} else {
+		err = w.pump.Drain(ctx)
 	}
 	w.cancel()
-	<-w.finished
+	if err == nil {
+		<-w.finished
+	}
 	return
 }
+
+// shutdown stops the pump, and then the queue.
+func (w *worker) shutdown(ctx context.Context) (err error) {
+	if err = w.stop(ctx, false); err != nil {
+		slog.Warn("Drain deadline exceeded, leaving messages in flight", "service", w.service.ID())
+	}
+	return w.queue.Shutdown()
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+type tokenMessage struct {
+	Token string `json:"token"`
+}
+
+func (msg tokenMessage) GetSquashKey() string {
+	return msg.Token
+}
+
+func (msg tokenMessage) GetToken() string {
+	return msg.Token
+}
+
+// fakeAdapter pushes tokenMessages using the push and squash functions set by
+// the test, accepting every push (or batch) for which no function is set.
+type fakeAdapter struct {
+	id      string
+	push    func(msg tokenMessage, fc FeedbackCollector) PushStatus
+	squash  func(msgs []tokenMessage, fc FeedbackCollector) PushStatus
+	lock    sync.Mutex
+	clients int
+}
+
+// countingAdapter returns an adapter sending the token of every message
+// pushed, squashed or not, to the channel.
+func countingAdapter(pushed chan string) *fakeAdapter {
+	return &fakeAdapter{
+		id: "counting",
+		push: func(msg tokenMessage, fc FeedbackCollector) PushStatus {
+			pushed <- msg.Token
+			return PushStatusSuccess
+		},
+		squash: func(msgs []tokenMessage, fc FeedbackCollector) PushStatus {
+			for _, msg := range msgs {
+				pushed <- msg.Token
+			}
+			return PushStatusSuccess
+		},
+	}
+}
+
+func (fa *fakeAdapter) ID() string {
+	return fa.id
+}
+
+func (fa *fakeAdapter) ConvertMessage(data []byte) (ServiceMessage, error) {
+	var msg tokenMessage
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+func (fa *fakeAdapter) NewClient() (PumpClient, error) {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+	fa.clients++
+	return nil, nil
+}
+
+func (fa *fakeAdapter) PushMessage(ctx context.Context, client PumpClient, smsg ServiceMessage, fc FeedbackCollector) PushStatus {
+	if fa.push == nil {
+		return PushStatusSuccess
+	}
+	return fa.push(smsg.(tokenMessage), fc)
+}
+
+func (fa *fakeAdapter) SquashAndPushMessage(ctx context.Context, client PumpClient, smsgs []ServiceMessage, fc FeedbackCollector) PushStatus {
+	if fa.squash == nil {
+		return PushStatusSuccess
+	}
+	msgs := make([]tokenMessage, len(smsgs))
+	for i, smsg := range smsgs {
+		msgs[i] = smsg.(tokenMessage)
+	}
+	return fa.squash(msgs, fc)
+}
+
+func (fa *fakeAdapter) Logger() *slog.Logger {
+	return slog.Default()
+}
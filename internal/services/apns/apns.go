@@ -2,6 +2,7 @@ package apns
 
 import (
 	"codeberg.org/pennersr/shove/internal/services"
+	"context"
 	"crypto/tls"
 	"github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/certificate"
@@ -9,8 +10,22 @@ import (
 	"time"
 )
 
+// tooManyRequestsDelay is the delay before retrying messages to device tokens
+// that received too many requests. APNS does not tell us how long to wait.
+const tooManyRequestsDelay = time.Minute
+
+// Config ...
+type Config struct {
+	// ID identifies the service, defaulting to "apns" in production, and
+	// to "apns-sandbox" otherwise.
+	ID         string
+	PEMFile    string
+	Production bool
+}
+
 // APNS ...
 type APNS struct {
+	id         string
 	production bool
 	log        *slog.Logger
 	cert       tls.Certificate
@@ -18,13 +33,22 @@ type APNS struct {
 
 // NewAPNS ...
 func NewAPNS(pemFile string, production bool, log *slog.Logger) (apns *APNS, err error) {
-	cert, err := certificate.FromPemFile(pemFile, "")
+	return NewAPNSWithConfig(Config{
+		PEMFile:    pemFile,
+		Production: production,
+	}, log)
+}
+
+// NewAPNSWithConfig ...
+func NewAPNSWithConfig(config Config, log *slog.Logger) (apns *APNS, err error) {
+	cert, err := certificate.FromPemFile(config.PEMFile, "")
 	if err != nil {
 		return
 	}
 	apns = &APNS{
+		id:         config.ID,
 		cert:       cert,
-		production: production,
+		production: config.Production,
 		log:        log,
 	}
 	return
@@ -47,34 +71,43 @@ func (apns *APNS) NewClient() (pclient services.PumpClient, err error) {
 
 // ID ...
 func (apns *APNS) ID() string {
+	if apns.id != "" {
+		return apns.id
+	}
 	if apns.production {
 		return "apns"
 	}
 	return "apns-sandbox"
-
 }
 
 // String ...
 func (apns *APNS) String() string {
-	if apns.production {
-		return "APNS"
+	name := "APNS"
+	if !apns.production {
+		name = "APNS-sandbox"
 	}
-	return "APNS-sandbox"
+	if apns.id != "" {
+		name += " (" + apns.id + ")"
+	}
+	return name
 }
 
-func (apns *APNS) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (apns *APNS) SquashAndPushMessage(ctx context.Context, client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
 	panic("not implemented")
 }
 
-func (apns *APNS) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (apns *APNS) PushMessage(ctx context.Context, pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
 	client := pclient.(*apns2.Client)
 	notif := smsg.(apnsNotification)
 	t := time.Now()
-	resp, err := client.Push(notif.notification)
+	ctx, span := services.StartSpan(ctx, apns, "APNS push")
+	resp, err := client.PushWithContext(ctx, notif.notification)
+	services.EndSpan(span, err)
 	duration := time.Now().Sub(t)
 	sent := false
 	if err != nil {
 		apns.log.Error("Push message failed", "error", err)
+		services.ReportDetails(fc, err.Error())
 		status = services.PushStatusTempFail
 	} else {
 		reason := resp.Reason
@@ -82,11 +115,17 @@ func (apns *APNS) PushMessage(pclient services.PumpClient, smsg services.Service
 			reason = "OK"
 		}
 		apns.log.Info("Pushed", "reason", reason, "duration", duration)
+		services.ReportDetails(fc, reason)
 		sent = resp.Sent()
 		if resp.Reason == apns2.ReasonBadDeviceToken || resp.Reason == apns2.ReasonUnregistered {
 			fc.TokenInvalid(apns.ID(), notif.notification.DeviceToken)
 		}
 		retry := resp.StatusCode >= 500
+		if resp.StatusCode == 429 {
+			// Too many requests for the device token, hold back only that one.
+			retry = true
+			services.ReportRetryAfter(fc, tooManyRequestsDelay, notif.notification.DeviceToken)
+		}
 		if sent {
 			status = services.PushStatusSuccess
 		} else if retry {
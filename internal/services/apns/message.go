@@ -22,6 +22,10 @@ func (notif apnsNotification) GetSquashKey() string {
 	panic("not implemented")
 }
 
+func (notif apnsNotification) GetToken() string {
+	return notif.notification.DeviceToken
+}
+
 func (apns *APNS) ConvertMessage(data []byte) (smsg services.ServiceMessage, err error) {
 	var msg apnsMessage
 	if err = json.Unmarshal(data, &msg); err != nil {
@@ -65,6 +69,14 @@ func (apns *APNS) ConvertMessage(data []byte) (smsg services.ServiceMessage, err
 			return
 		}
 		notif.Expiration = time.Unix(epoch, 0)
+	} else {
+		var env services.Envelope
+		if env, err = services.ParseEnvelope(data); err != nil {
+			return
+		}
+		if env.ExpiresAt != nil {
+			notif.Expiration = *env.ExpiresAt
+		}
 	}
 	notif.Payload = msg.Payload
 	smsg = apnsNotification{notification: notif}
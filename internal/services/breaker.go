@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BreakerState ...
+type BreakerState string
+
+const (
+	// BreakerClosed lets messages through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen holds back all messages, as the service appears to be down.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single message through, probing whether or not
+	// the service is back up.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerConfig ...
+type BreakerConfig struct {
+	// Threshold is the number of consecutive temporary failures, across all
+	// workers, after which the breaker opens. Zero disables the breaker.
+	Threshold int
+	// Cooldown is the period the breaker stays open before probing.
+	Cooldown time.Duration
+}
+
+// BreakerStatus ...
+type BreakerStatus struct {
+	State BreakerState `json:"state"`
+	// Failures is the number of consecutive temporary failures.
+	Failures int        `json:"consecutive_failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// breaker is the circuit breaker shared by the workers of a pump, so that an
+// outage of the upstream service suspends pushing altogether instead of each
+// worker backing off on its own.
+type breaker struct {
+	config    BreakerConfig
+	serviceID string
+	lock      sync.Mutex
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	// changed is closed (and replaced) whenever the state changes, waking
+	// up the workers waiting for the breaker.
+	changed chan struct{}
+}
+
+func newBreaker(config BreakerConfig, serviceID string) *breaker {
+	return &breaker{
+		config:    config,
+		serviceID: serviceID,
+		state:     BreakerClosed,
+		changed:   make(chan struct{}),
+	}
+}
+
+func (b *breaker) setState(state BreakerState, fc FeedbackCollector) {
+	b.state = state
+	if state == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+	fc.BreakerStateChanged(b.serviceID, state)
+}
+
+// acquire blocks until the breaker lets a message through, returning whether
+// or not that message is the probe of a half-open breaker. Every acquire
+// needs to be followed by a call to record.
+func (b *breaker) acquire(ctx context.Context, fc FeedbackCollector) (probe bool, err error) {
+	for {
+		b.lock.Lock()
+		now := time.Now()
+		reopensAt := b.openedAt.Add(b.config.Cooldown)
+		if b.state == BreakerOpen && !now.Before(reopensAt) {
+			b.setState(BreakerHalfOpen, fc)
+		}
+		switch b.state {
+		case BreakerClosed:
+			b.lock.Unlock()
+			return
+		case BreakerHalfOpen:
+			if !b.probing {
+				b.probing = true
+				b.lock.Unlock()
+				probe = true
+				return
+			}
+		}
+		changed := b.changed
+		open := b.state == BreakerOpen
+		b.lock.Unlock()
+
+		// While open, wait for the cooldown to pass. While half-open, wait
+		// for the probe to finish.
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if open {
+			timer = time.NewTimer(reopensAt.Sub(now))
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// record updates the breaker with the outcome of a message let through. Only
+// temporary failures count, messages that were not pushed at all (e.g. as
+// they expired) leave the breaker untouched.
+func (b *breaker) record(probe bool, pushed bool, failed bool, fc FeedbackCollector) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if !pushed {
+		if probe {
+			// Let another worker probe.
+			close(b.changed)
+			b.changed = make(chan struct{})
+		}
+		return
+	}
+	if !failed {
+		b.failures = 0
+		if probe && b.state == BreakerHalfOpen {
+			b.setState(BreakerClosed, fc)
+		}
+		return
+	}
+	b.failures++
+	if probe && b.state == BreakerHalfOpen {
+		b.setState(BreakerOpen, fc)
+	} else if b.state == BreakerClosed && b.config.Threshold > 0 && b.failures >= b.config.Threshold {
+		b.setState(BreakerOpen, fc)
+	}
+}
+
+func (b *breaker) status() (status BreakerStatus) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	status.State = b.state
+	status.Failures = b.failures
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return
+}
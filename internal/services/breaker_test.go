@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type breakerCollector struct {
+	FeedbackCollector
+	lock   sync.Mutex
+	states []BreakerState
+}
+
+func (bc *breakerCollector) BreakerStateChanged(serviceID string, state BreakerState) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.states = append(bc.states, state)
+}
+
+func TestBreaker(t *testing.T) {
+	fc := &breakerCollector{}
+	b := newBreaker(BreakerConfig{Threshold: 2, Cooldown: 50 * time.Millisecond}, "test")
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		probe, err := b.acquire(ctx, fc)
+		if err != nil || probe {
+			t.Fatal(probe, err)
+		}
+		b.record(probe, true, true, fc)
+	}
+	if status := b.status(); status.State != BreakerOpen || status.Failures != 2 {
+		t.Fatal(status)
+	}
+
+	// Nothing is let through while open.
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.acquire(timeout, fc); err == nil {
+		t.Fatal("acquired while open")
+	}
+
+	// Once the cooldown passed, a single probe is let through.
+	startedAt := time.Now()
+	probe, err := b.acquire(ctx, fc)
+	if err != nil || !probe || time.Since(startedAt) < 30*time.Millisecond {
+		t.Fatal(probe, err)
+	}
+	acquired := make(chan bool)
+	go func() {
+		probe, _ := b.acquire(ctx, fc)
+		acquired <- probe
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired while probing")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// A successful probe closes the breaker.
+	b.record(probe, true, false, fc)
+	if probe := <-acquired; probe {
+		t.Fatal("probing while closed")
+	}
+	if status := b.status(); status.State != BreakerClosed || status.Failures != 0 {
+		t.Fatal(status)
+	}
+	expected := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(fc.states) != len(expected) {
+		t.Fatal(fc.states)
+	}
+	for i, state := range expected {
+		if fc.states[i] != state {
+			t.Fatal(fc.states)
+		}
+	}
+}
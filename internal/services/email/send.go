@@ -2,8 +2,12 @@ package email
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/smtp"
+	"net/textproto"
 	"time"
 
 	"codeberg.org/pennersr/shove/internal/services"
@@ -29,7 +33,7 @@ func (ec EmailConfig) send(from string, to []string, body []byte, fc services.Fe
 		}
 	}
 	duration := time.Since(t)
-	fc.CountPush(serviceID, err == nil, duration)
+	fc.CountPush(ec.ID, err == nil, duration)
 
 	if err != nil {
 		ec.Log.Error("Send failed", "error", err)
@@ -38,6 +42,23 @@ func (ec EmailConfig) send(from string, to []string, body []byte, fc services.Fe
 	return nil
 }
 
+// sendStatus tells temporary failures, such as the SMTP server being
+// unreachable or replying with a 4xx code, apart from permanent ones.
+func sendStatus(err error) services.PushStatus {
+	var replyErr *textproto.Error
+	if errors.As(err, &replyErr) {
+		if replyErr.Code >= 400 && replyErr.Code < 500 {
+			return services.PushStatusTempFail
+		}
+		return services.PushStatusHardFail
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return services.PushStatusTempFail
+	}
+	return services.PushStatusHardFail
+}
+
 func (ec EmailConfig) sendMailTLS(addr string, auth smtp.Auth, from string, to []string, body []byte) error {
 	var t *tls.Config
 	if ec.TLSInsecure {
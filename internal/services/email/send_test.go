@@ -0,0 +1,84 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/services"
+	"golang.org/x/exp/slog"
+)
+
+type pushCollector struct {
+	services.FeedbackCollector
+}
+
+func (pushCollector) CountPush(serviceID string, success bool, duration time.Duration) {
+}
+
+// fakeSMTP serves a single SMTP session, accepting every command except RCPT,
+// which is answered using the given reply. An empty reply hangs up instead.
+func fakeSMTP(t *testing.T, rcptReply string) (addr *net.TCPAddr) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			reply := "250 OK"
+			if strings.HasPrefix(line, "RCPT") {
+				if rcptReply == "" {
+					return
+				}
+				reply = rcptReply
+			}
+			conn.Write([]byte(reply + "\r\n"))
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestSendStatus(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	for _, tc := range []struct {
+		name   string
+		addr   *net.TCPAddr
+		to     string
+		status services.PushStatus
+	}{
+		{"unreachable", closed.Addr().(*net.TCPAddr), "to@example.com", services.PushStatusTempFail},
+		{"hung up", fakeSMTP(t, ""), "to@example.com", services.PushStatusTempFail},
+		{"mailbox busy", fakeSMTP(t, "450 Mailbox busy"), "to@example.com", services.PushStatusTempFail},
+		{"no such user", fakeSMTP(t, "550 No such user"), "to@example.com", services.PushStatusHardFail},
+		{"bad address", fakeSMTP(t, "250 OK"), "not an address", services.PushStatusHardFail},
+	} {
+		es, _ := NewEmailService(EmailConfig{
+			EmailHost: tc.addr.IP.String(),
+			EmailPort: tc.addr.Port,
+			Log:       slog.Default(),
+		})
+		status := es.push(context.Background(), "from@example.com", []string{tc.to}, []byte("Hello"), pushCollector{})
+		if status != tc.status {
+			t.Error(tc.name, status)
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package email
 
 import (
+	"context"
+
 	"golang.org/x/exp/slog"
 
 	"codeberg.org/pennersr/shove/internal/services"
 )
 
-const serviceID = "email"
-
 type EmailConfig struct {
+	// ID identifies the service, defaulting to "email".
+	ID            string
 	EmailHost     string
 	EmailPort     int
 	Log           *slog.Logger
@@ -24,6 +26,9 @@ type EmailService struct {
 }
 
 func NewEmailService(config EmailConfig) (es *EmailService, err error) {
+	if config.ID == "" {
+		config.ID = "email"
+	}
 	es = &EmailService{
 		config: config,
 	}
@@ -35,10 +40,13 @@ func (es *EmailService) Logger() *slog.Logger {
 }
 
 func (es *EmailService) ID() string {
-	return serviceID
+	return es.config.ID
 }
 
 func (es *EmailService) String() string {
+	if es.config.ID != "email" {
+		return "Email (" + es.config.ID + ")"
+	}
 	return "Email"
 }
 
@@ -46,7 +54,7 @@ func (es *EmailService) NewClient() (services.PumpClient, error) {
 	return nil, nil
 }
 
-func (es *EmailService) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (es *EmailService) SquashAndPushMessage(ctx context.Context, client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
 	emails := make([]email, len(smsgs))
 	for i, smsg := range smsgs {
 		emails[i] = smsg.(email)
@@ -55,23 +63,26 @@ func (es *EmailService) SquashAndPushMessage(client services.PumpClient, smsgs [
 	if err != nil {
 		return services.PushStatusHardFail
 	}
-	return es.push(emails[0].From, emails[0].To, body, fc)
+	return es.push(ctx, emails[0].From, emails[0].To, body, fc)
 }
 
-func (es *EmailService) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (es *EmailService) PushMessage(ctx context.Context, pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
 	email := smsg.(email)
 	es.config.Log.Info("Sending email")
 	body, err := encodeEmail(email)
 	if err != nil {
 		return services.PushStatusHardFail
 	}
-	return es.push(email.From, email.To, body, fc)
+	return es.push(ctx, email.From, email.To, body, fc)
 }
-func (es *EmailService) push(from string, to []string, body []byte, fc services.FeedbackCollector) services.PushStatus {
+func (es *EmailService) push(ctx context.Context, from string, to []string, body []byte, fc services.FeedbackCollector) services.PushStatus {
+	_, span := services.StartSpan(ctx, es, "SMTP send")
 	err := es.config.send(from, to, body, fc)
+	services.EndSpan(span, err)
 	if err != nil {
 		es.config.Log.Error("Failed to send email", "error", err)
-		return services.PushStatusHardFail // TODO: smtp down is not a hard failure
+		services.ReportDetails(fc, err.Error())
+		return sendStatus(err)
 	}
 	return services.PushStatusSuccess
 }
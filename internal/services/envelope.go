@@ -0,0 +1,148 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Envelope holds the message fields that are interpreted by Shove itself,
+// regardless of the service the message is pushed to.
+type Envelope struct {
+	// ID is an idempotency key, used to reject duplicate pushes.
+	ID string `json:"id,omitempty"`
+	// MessageID is assigned by Shove when accepting a message, and is used to
+	// keep track of its status.
+	MessageID string `json:"message_id,omitempty"`
+	// SendAt is the time before which the message is not to be pushed.
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// Delay (in seconds) is relative to the time the message is queued, and
+	// is converted into SendAt before queueing.
+	Delay int `json:"delay,omitempty"`
+	// ExpiresAt is the time after which the message is no longer worth
+	// pushing.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// TTL (in seconds) is relative to the time the message is queued, and is
+	// converted into ExpiresAt before queueing.
+	TTL int `json:"ttl,omitempty"`
+	// TraceContext holds the context of the trace the message was pushed in,
+	// as propagated using the W3C Trace Context format.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	// Squash overrides how the message is squashed, for services that
+	// squash messages when the rate is exceeded.
+	Squash *SquashOptions `json:"squash,omitempty"`
+}
+
+// SquashOptions ...
+type SquashOptions struct {
+	// Disable pushes the message regardless of the rate, never squashing
+	// it (e.g. password reset emails).
+	Disable bool `json:"disable,omitempty"`
+	// Key groups the messages to the same destination that are rated and
+	// squashed together (e.g. a digest per thread), instead of all of them.
+	Key string `json:"key,omitempty"`
+}
+
+// ParseEnvelope ...
+func ParseEnvelope(data []byte) (env Envelope, err error) {
+	err = json.Unmarshal(data, &env)
+	return
+}
+
+// NewMessageID ...
+func NewMessageID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// AssignMessageID adds the message ID to the envelope of the message.
+func AssignMessageID(data []byte, id string) (msg []byte, err error) {
+	return setEnvelopeField(data, "message_id", id)
+}
+
+// AssignTraceContext adds the trace context to the envelope of the message.
+func AssignTraceContext(data []byte, traceContext map[string]string) (msg []byte, err error) {
+	return setEnvelopeField(data, "trace_context", traceContext)
+}
+
+func setEnvelopeField(data []byte, name string, value interface{}) (msg []byte, err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+	if fields[name], err = json.Marshal(value); err != nil {
+		return
+	}
+	msg, err = json.Marshal(fields)
+	return
+}
+
+// PrepareMessage resolves the relative envelope fields of a message into
+// absolute ones, so that they keep their meaning while the message is queued.
+func PrepareMessage(data []byte, now time.Time) (msg []byte, env Envelope, err error) {
+	if env, err = ParseEnvelope(data); err != nil {
+		return
+	}
+	msg = data
+	if env.Delay == 0 && env.TTL == 0 {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+	if env.Delay != 0 {
+		sendAt := now.Add(time.Duration(env.Delay) * time.Second)
+		env.SendAt = &sendAt
+		env.Delay = 0
+		delete(fields, "delay")
+		if fields["send_at"], err = json.Marshal(sendAt); err != nil {
+			return
+		}
+	}
+	if env.TTL != 0 {
+		// The TTL starts counting once the message is due.
+		expiresAt := now.Add(time.Duration(env.TTL) * time.Second)
+		if env.SendAt != nil {
+			expiresAt = env.SendAt.Add(time.Duration(env.TTL) * time.Second)
+		}
+		env.ExpiresAt = &expiresAt
+		env.TTL = 0
+		delete(fields, "ttl")
+		if fields["expires_at"], err = json.Marshal(expiresAt); err != nil {
+			return
+		}
+	}
+	msg, err = json.Marshal(fields)
+	return
+}
+
+// Due tells whether or not the message is due to be pushed.
+func (env Envelope) Due(now time.Time) bool {
+	return env.SendAt == nil || !env.SendAt.After(now)
+}
+
+// Expired tells whether or not the message has expired.
+func (env Envelope) Expired(now time.Time) bool {
+	return env.ExpiresAt != nil && env.ExpiresAt.Before(now)
+}
+
+// squashes tells whether or not the message may be squashed.
+func (env Envelope) squashes() bool {
+	return env.Squash == nil || !env.Squash.Disable
+}
+
+// squashKey returns the key the message is rated and squashed by. Custom keys
+// are scoped to the destination of the message, as a batch is pushed to the
+// destination of its first message.
+func (env Envelope) squashKey(smsg ServiceMessage) string {
+	key := smsg.GetSquashKey()
+	if env.Squash != nil && env.Squash.Key != "" {
+		key += "#" + env.Squash.Key
+	}
+	return key
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrepareMessageDelay(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	msg, env, err := PrepareMessage([]byte(`{"delay": 60, "token": "abc"}`), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.SendAt.Equal(now.Add(time.Minute)) {
+		t.Fatal(env.SendAt)
+	}
+	if env.Due(now) {
+		t.Fatal("due too early")
+	}
+	if string(msg) != `{"send_at":"2024-01-01T12:01:00Z","token":"abc"}` {
+		t.Fatal(string(msg))
+	}
+	env, err = ParseEnvelope(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.Due(now.Add(time.Minute)) {
+		t.Fatal("not due")
+	}
+}
+
+func TestPrepareMessageUntouched(t *testing.T) {
+	data := []byte(`{"send_at": "2024-01-01T12:01:00Z", "token": "abc"}`)
+	msg, _, err := PrepareMessage(data, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != string(data) {
+		t.Fatal(string(msg))
+	}
+}
+
+func TestPrepareMessageTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	msg, env, err := PrepareMessage([]byte(`{"delay": 60, "ttl": 30}`), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != `{"expires_at":"2024-01-01T12:01:30Z","send_at":"2024-01-01T12:01:00Z"}` {
+		t.Fatal(string(msg))
+	}
+	if env.Expired(now.Add(90 * time.Second)) {
+		t.Fatal("expired too early")
+	}
+	if !env.Expired(now.Add(91 * time.Second)) {
+		t.Fatal("not expired")
+	}
+}
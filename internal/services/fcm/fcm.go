@@ -11,16 +11,37 @@ import (
 	"time"
 )
 
+// quotaExceededDelay is the delay before retrying messages that exceeded the
+// sending quota, as recommended by FCM.
+const quotaExceededDelay = time.Minute
+
+// Config ...
+type Config struct {
+	// ID identifies the service, defaulting to "fcm".
+	ID              string
+	CredentialsFile string
+}
+
 // FCM ...
 type FCM struct {
+	id              string
 	credentialsFile string
 	log             *slog.Logger
 }
 
 // NewFCM ...
 func NewFCM(credentialsFile string, log *slog.Logger) (fcm *FCM, err error) {
+	return NewFCMWithConfig(Config{CredentialsFile: credentialsFile}, log)
+}
+
+// NewFCMWithConfig ...
+func NewFCMWithConfig(config Config, log *slog.Logger) (fcm *FCM, err error) {
+	if config.ID == "" {
+		config.ID = "fcm"
+	}
 	fcm = &FCM{
-		credentialsFile: credentialsFile,
+		id:              config.ID,
+		credentialsFile: config.CredentialsFile,
 		log:             log,
 	}
 	return
@@ -32,11 +53,14 @@ func (fcm *FCM) Logger() *slog.Logger {
 
 // ID ...
 func (fcm *FCM) ID() string {
-	return "fcm"
+	return fcm.id
 }
 
 // String ...
 func (fcm *FCM) String() string {
+	if fcm.id != "fcm" {
+		return "FCM (" + fcm.id + ")"
+	}
 	return "FCM"
 }
 
@@ -54,26 +78,40 @@ func (fcm *FCM) NewClient() (services.PumpClient, error) {
 	return client, nil
 }
 
-func (fcm *FCM) SquashAndPushMessage(services.PumpClient, []services.ServiceMessage, services.FeedbackCollector) services.PushStatus {
+func (fcm *FCM) SquashAndPushMessage(context.Context, services.PumpClient, []services.ServiceMessage, services.FeedbackCollector) services.PushStatus {
 	panic("not implemented")
 }
 
-func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (fcm *FCM) PushMessage(ctx context.Context, pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
 	msg := smsg.(fcmMessage)
 	startedAt := time.Now()
 	var success bool
 
 	client := pclient.(*messaging.Client)
-	_, err := client.Send(context.Background(), msg.Message)
+	ctx, span := services.StartSpan(ctx, fcm, "FCM send")
+	_, err := client.Send(ctx, msg.Message)
+	services.EndSpan(span, err)
 	duration := time.Now().Sub(startedAt)
 	defer func() {
 		fc.CountPush(fcm.ID(), success, duration)
 	}()
 	fcm.log.Info("Pushed", "duration", duration)
 	if err != nil {
+		services.ReportDetails(fc, err.Error())
 		// TODO: Isn't there a better way?
 		if strings.Contains(err.Error(), "registration-token-not-registered") {
 			fc.TokenInvalid(fcm.ID(), msg.Message.Token)
+		} else if messaging.IsMessageRateExceeded(err) {
+			// Either the quota of the device, or the quota of the project
+			// (e.g. when pushing to topics) is exceeded, in which case the
+			// whole service pauses.
+			fcm.log.Error("Quota exceeded", "error", err)
+			token := ""
+			if isDeviceQuotaExceeded(err) {
+				token = msg.Message.Token
+			}
+			services.ReportRetryAfter(fc, quotaExceededDelay, token)
+			return services.PushStatusTempFail
 		} else {
 			fcm.log.Error("Posting failed", "error", err)
 		}
@@ -82,3 +120,9 @@ func (fcm *FCM) PushMessage(pclient services.PumpClient, smsg services.ServiceMe
 	success = true
 	return services.PushStatusSuccess
 }
+
+// isDeviceQuotaExceeded returns whether the quota exceeded is the one of the
+// device, which FCM only tells in the details of the error message.
+func isDeviceQuotaExceeded(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "device message rate exceeded")
+}
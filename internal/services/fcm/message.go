@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"firebase.google.com/go/messaging"
+	"time"
 )
 
 type fcmMessage struct {
@@ -15,6 +16,10 @@ func (fcmMessage) GetSquashKey() string {
 	panic("not implemented")
 }
 
+func (msg fcmMessage) GetToken() string {
+	return msg.Message.Token
+}
+
 func (fcm *FCM) ConvertMessage(data []byte) (smsg services.ServiceMessage, err error) {
 	var msg fcmMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
@@ -26,6 +31,19 @@ func (fcm *FCM) ConvertMessage(data []byte) (smsg services.ServiceMessage, err e
 	if msg.Message.Token == "" {
 		return nil, errors.New("no token specified")
 	}
+	env, err := services.ParseEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	if env.ExpiresAt != nil {
+		if msg.Message.Android == nil {
+			msg.Message.Android = new(messaging.AndroidConfig)
+		}
+		if msg.Message.Android.TTL == nil {
+			ttl := max(time.Until(*env.ExpiresAt), 0)
+			msg.Message.Android.TTL = &ttl
+		}
+	}
 	return msg, nil
 }
 
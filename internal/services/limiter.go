@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimit ...
+type RateLimit struct {
+	// Rate is the number of pushes per second, across all workers and
+	// including squashed batches. Zero means unlimited.
+	Rate float64
+	// Burst is the number of pushes that can go out at once after having
+	// been idle, defaulting to one.
+	Burst int
+}
+
+// limiter is the token bucket shared by the workers of a pump, capping the
+// total rate at which the upstream service is pushed to. Tokens are taken
+// ahead of time, so that waiting workers are let through in turn.
+type limiter struct {
+	rate   float64
+	burst  float64
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(config RateLimit) *limiter {
+	if config.Rate <= 0 {
+		return nil
+	}
+	burst := float64(max(config.Burst, 1))
+	return &limiter{
+		rate:   config.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token, returning how long to wait before it can be used.
+func (l *limiter) reserve(now time.Time) (delay time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.After(l.last) {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+	}
+	l.tokens--
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	return
+}
+
+// cancel hands back a token that was reserved but not used.
+func (l *limiter) cancel() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tokens = min(l.burst, l.tokens+1)
+}
+
+// wait blocks until a push is allowed, returning the time spent waiting. A
+// nil limiter never waits.
+func (l *limiter) wait(ctx context.Context) (waited time.Duration, err error) {
+	if l == nil {
+		return
+	}
+	waited = l.reserve(time.Now())
+	if waited == 0 {
+		return
+	}
+	timer := time.NewTimer(waited)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		l.cancel()
+		waited, err = 0, ctx.Err()
+	}
+	return
+}
+
+// throttle waits for the limiter before pushing, recording the time spent
+// being throttled.
+func throttle(ctx context.Context, l *limiter, adapter PumpAdapter, fc FeedbackCollector) {
+	waited, _ := l.wait(ctx)
+	if waited > 0 {
+		adapter.Logger().Debug("Throttled", "duration", waited)
+		fc.CountThrottle(adapter.ID(), waited)
+	}
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+)
+
+type throttleCollector struct {
+	FeedbackCollector
+	lock      sync.Mutex
+	throttled time.Duration
+}
+
+func (tc *throttleCollector) CountThrottle(serviceID string, duration time.Duration) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.throttled += duration
+}
+
+func TestRateLimit(t *testing.T) {
+	pushed := make(chan string, 10)
+	adapter := countingAdapter(pushed)
+	p := NewPump(PumpConfig{
+		Workers:   4,
+		RateLimit: RateLimit{Rate: 20, Burst: 2},
+	}, adapter)
+	q, err := memory.MemoryQueueFactory{}.NewQueue("counting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = q.Queue([]byte(fmt.Sprintf(`{"token": "%d"}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc := &throttleCollector{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startedAt := time.Now()
+	go p.Serve(ctx, q, fc)
+	for i := 0; i < 10; i++ {
+		select {
+		case <-pushed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not pushed", i)
+		}
+	}
+	// The burst goes out at once, the other 8 messages at 20 per second
+	// regardless of the number of workers.
+	if elapsed := time.Since(startedAt); elapsed < 350*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.throttled == 0 {
+		t.Fatal("throttling not recorded")
+	}
+}
@@ -8,13 +8,59 @@ import (
 	"time"
 
 	"codeberg.org/pennersr/shove/internal/queue"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Pump struct {
-	wg       sync.WaitGroup
-	adapter  PumpAdapter
-	workers  int
-	squasher *squasher
+	wg          sync.WaitGroup
+	adapter     PumpAdapter
+	maxAttempts int
+	squasher    *squasher
+	pauses      pauses
+	breaker     *breaker
+	limiter     *limiter
+	// lock guards the workers and the paused state, both of which can be
+	// changed while serving.
+	lock    sync.Mutex
+	workers int
+	// cancels stops the running workers, one for each.
+	cancels []context.CancelFunc
+	serving *serving
+	// stop and stopped are set while serving, see Drain.
+	stop    context.CancelFunc
+	stopped chan struct{}
+	// draining bounds the flushing of the squasher once the pump is
+	// drained.
+	draining context.Context
+	// handingOver is set when the pending squash batches are left for the
+	// pump taking over, see Handover.
+	handingOver bool
+	paused      bool
+	// resumed is closed when a paused pump resumes.
+	resumed chan struct{}
+}
+
+// serving is what the workers started by Serve (and later on SetWorkers) work
+// with.
+type serving struct {
+	ctx context.Context
+	q   queue.Queue
+	fc  FeedbackCollector
+}
+
+// PumpConfig ...
+type PumpConfig struct {
+	Workers int
+	Squash  SquashConfig
+	// MaxAttempts is the number of attempts after which a message that keeps
+	// failing temporarily is moved to the dead-letter queue. Zero means
+	// unlimited.
+	MaxAttempts int
+	Breaker     BreakerConfig
+	// RateLimit caps the total rate at which the service is pushed to.
+	RateLimit RateLimit
 }
 
 type ServiceMessage interface {
@@ -32,73 +78,135 @@ const (
 	PushStatusHardFail
 )
 
+func (status PushStatus) messageState() MessageState {
+	switch status {
+	case PushStatusSuccess:
+		return MessageDelivered
+	case PushStatusTempFail:
+		return MessageTempFailed
+	default:
+		return MessageHardFailed
+	}
+}
+
 type PumpClient interface {
 }
 
 type PumpAdapter interface {
+	ID() string
 	ConvertMessage([]byte) (ServiceMessage, error)
 	NewClient() (PumpClient, error)
-	PushMessage(client PumpClient, smsg ServiceMessage, fc FeedbackCollector) PushStatus
-	SquashAndPushMessage(client PumpClient, smsgs []ServiceMessage, fc FeedbackCollector) PushStatus
+	// PushMessage pushes the message upstream. The context carries the
+	// span of the delivery, see StartSpan. A temporary failure can be
+	// accompanied by the delay after which to retry, see ReportRetryAfter.
+	PushMessage(ctx context.Context, client PumpClient, smsg ServiceMessage, fc FeedbackCollector) PushStatus
+	SquashAndPushMessage(ctx context.Context, client PumpClient, smsgs []ServiceMessage, fc FeedbackCollector) PushStatus
 	Logger() *slog.Logger
 }
 
 // NewPump
-func NewPump(workers int, squash SquashConfig, adapter PumpAdapter) (p *Pump) {
+func NewPump(config PumpConfig, adapter PumpAdapter) (p *Pump) {
 	p = &Pump{
-		workers: workers,
-		adapter: adapter,
+		workers:     config.Workers,
+		maxAttempts: config.MaxAttempts,
+		adapter:     adapter,
+		breaker:     newBreaker(config.Breaker, adapter.ID()),
+		limiter:     newLimiter(config.RateLimit),
 	}
-	if squash.RateMax > 0 {
-		p.squasher = newSquasher(squash, adapter)
+	if config.Squash.RateMax > 0 {
+		p.squasher = newSquasher(config.Squash, config.MaxAttempts, adapter)
+		p.squasher.limiter = p.limiter
 	}
 	return p
 }
 
-func (p *Pump) push(q queue.Queue, qm queue.QueuedMessage, client PumpClient, smsg ServiceMessage, fc FeedbackCollector) (status PushStatus, squashed bool) {
-	if p.squasher != nil {
-		squashed = p.squasher.prepareToPush(q, qm, client, smsg)
+// BreakerStatus returns the status of the circuit breaker of the pump.
+func (p *Pump) BreakerStatus() BreakerStatus {
+	return p.breaker.status()
+}
+
+func (p *Pump) push(ctx context.Context, q queue.Queue, qm queue.QueuedMessage, env Envelope, client PumpClient, smsg ServiceMessage, fc FeedbackCollector) (status PushStatus, retry retryAfter, squashed bool) {
+	if p.squasher != nil && env.squashes() {
+		squashed = p.squasher.prepareToPush(q, qm, env.squashKey(smsg), fc)
 		if squashed {
+			track(fc, p.adapter, env.MessageID, MessageSquashed, "", qm.Attempts())
 			return
 		}
 	}
-	status = p.adapter.PushMessage(client, smsg, fc)
+	throttle(ctx, p.limiter, p.adapter, fc)
+	track(fc, p.adapter, env.MessageID, MessageSending, "", qm.Attempts()+1)
+	mc := &messageCollector{FeedbackCollector: fc}
+	status = p.adapter.PushMessage(ctx, client, smsg, mc)
+	track(fc, p.adapter, env.MessageID, status.messageState(), mc.details, qm.Attempts()+1)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("shove.state", string(status.messageState())))
+	if status != PushStatusSuccess {
+		span.SetStatus(codes.Error, mc.details)
+	}
+	if status == PushStatusTempFail && mc.retry.delay > 0 {
+		retry = mc.retry
+		span.SetAttributes(attribute.Float64("shove.retry_after", retry.delay.Seconds()))
+	}
 	return
 }
 
+// track records the state of messages that carry a message ID.
+func track(fc FeedbackCollector, adapter PumpAdapter, messageID string, state MessageState, details string, attempts int) {
+	if messageID == "" {
+		return
+	}
+	fc.TrackMessage(MessageStatus{
+		ID:        messageID,
+		Service:   adapter.ID(),
+		State:     state,
+		Details:   details,
+		Attempts:  attempts,
+		UpdatedAt: time.Now(),
+	})
+}
+
 func (p *Pump) serveClient(ctx context.Context, q queue.Queue, client PumpClient, fc FeedbackCollector) {
 	defer func() {
 		p.wg.Done()
 	}()
 	failureCount := 0
-	log := p.adapter.Logger()
 	for ctx.Err() == nil {
-		qm, err := q.Get(ctx)
+		if err := p.waitResumed(ctx); err != nil {
+			return
+		}
+		probe, err := p.breaker.acquire(ctx, fc)
 		if err != nil {
-			slog.Error("Unable to read from queue", "error", err)
 			return
 		}
-		msg := qm.Message()
-		smsg, err := p.adapter.ConvertMessage(msg)
+		qm, err := q.Get(ctx)
 		if err != nil {
-			slog.Error("Bad message", "error", err)
-			removeFromQueue(q, qm, log)
-			continue
+			p.breaker.record(probe, false, false, fc)
+			if ctx.Err() == nil {
+				slog.Error("Unable to read from queue", "error", err)
+			}
+			return
 		}
-		status, squashed := p.push(q, qm, client, smsg, fc)
-		if squashed {
-			// Message should remain in pending queue
+		if p.Paused() {
+			// Paused while waiting for the message, put it back.
+			p.breaker.record(probe, false, false, fc)
+			if err = q.Postpone(qm, time.Now()); err != nil {
+				slog.Error("Unable to postpone", "error", err)
+			}
 			continue
 		}
-		if status == PushStatusSuccess || status == PushStatusHardFail {
-			removeFromQueue(q, qm, log)
-		} else {
-			if err = q.Requeue(qm); err != nil {
-				slog.Error("Unable to requeue", "error", err)
-			}
+		status, retry, pushed := p.process(q, qm, client, fc)
+		// Being throttled is not a sign of the service being down.
+		p.breaker.record(probe, pushed, status == PushStatusTempFail && retry.delay == 0, fc)
+		if !pushed {
+			continue
 		}
 		if status == PushStatusTempFail {
-			p.backoff(ctx, failureCount)
+			if retry.delay > 0 && retry.token == "" {
+				// The upstream service told us how long to wait.
+				p.sleep(ctx, withJitter(retry.delay), fc)
+			} else if retry.delay == 0 {
+				p.backoff(ctx, failureCount, fc)
+			}
 			failureCount++
 
 		} else {
@@ -107,51 +215,218 @@ func (p *Pump) serveClient(ctx context.Context, q queue.Queue, client PumpClient
 	}
 }
 
+// process handles a message taken from the queue, returning whether or not it
+// was pushed upstream (as opposed to being squashed, postponed or dropped), and
+// the delay before retrying if the upstream service asked for one.
+func (p *Pump) process(q queue.Queue, qm queue.QueuedMessage, client PumpClient, fc FeedbackCollector) (status PushStatus, retry retryAfter, pushed bool) {
+	log := p.adapter.Logger()
+	msg := qm.Message()
+	env, err := ParseEnvelope(msg)
+	if err != nil {
+		log.Error("Bad envelope", "error", err)
+		moveToDeadLetterQueue(q, qm, log)
+		return
+	}
+	if !env.Due(time.Now()) {
+		// Not to be picked up before it is due.
+		if err = q.Postpone(qm, *env.SendAt); err != nil {
+			log.Error("Unable to postpone", "error", err)
+		}
+		return
+	}
+	// The delivery is not tied to the lifetime of the pump, so that messages
+	// being pushed while shutting down are not cut short.
+	ctx, span := tracer.Start(ExtractTraceContext(context.Background(), env), "deliver "+p.adapter.ID(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("shove.service", p.adapter.ID()),
+			attribute.String("shove.message_id", env.MessageID),
+			attribute.Int("shove.attempt", qm.Attempts()+1),
+		),
+	)
+	defer span.End()
+	smsg, err := p.adapter.ConvertMessage(msg)
+	if err != nil {
+		log.Error("Bad message", "error", err)
+		moveToDeadLetterQueue(q, qm, log)
+		track(fc, p.adapter, env.MessageID, MessageDead, err.Error(), qm.Attempts())
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	var token string
+	if tmsg, ok := smsg.(TokenMessage); ok {
+		token = tmsg.GetToken()
+	}
+	if env.Expired(time.Now()) {
+		log.Info("Expired", "expires_at", env.ExpiresAt)
+		removeFromQueue(q, qm, log)
+		fc.MessageExpired(p.adapter.ID(), token)
+		track(fc, p.adapter, env.MessageID, MessageExpired, "", qm.Attempts())
+		span.SetAttributes(attribute.String("shove.state", string(MessageExpired)))
+		return
+	}
+	if until, paused := p.pauses.pausedUntil(token, time.Now()); paused {
+		// The upstream service asked us to hold back messages to this token.
+		if err = q.Postpone(qm, until); err != nil {
+			log.Error("Unable to postpone", "error", err)
+		}
+		span.SetAttributes(attribute.String("shove.state", "paused"))
+		return
+	}
+	status, retry, squashed := p.push(ctx, q, qm, env, client, smsg, fc)
+	if squashed {
+		// Message should remain in pending queue
+		return
+	}
+	pushed = true
+	if status == PushStatusSuccess || status == PushStatusHardFail {
+		removeFromQueue(q, qm, log)
+	} else if p.exhausted(qm) {
+		log.Error("Giving up, maximum attempts reached", "attempts", qm.Attempts()+1)
+		moveToDeadLetterQueue(q, qm, log)
+		track(fc, p.adapter, env.MessageID, MessageDead, "maximum attempts reached", qm.Attempts()+1)
+	} else {
+		if err = q.Requeue(qm); err != nil {
+			slog.Error("Unable to requeue", "error", err)
+		}
+	}
+	if retry.token != "" {
+		until := time.Now().Add(withJitter(retry.delay))
+		log.Info("Holding back token", "until", until)
+		p.pauses.pause(retry.token, until)
+	}
+	return
+}
+
 func removeFromQueue(q queue.Queue, qm queue.QueuedMessage, log *slog.Logger) {
 	if err := q.Remove(qm); err != nil {
 		slog.Error("Unable to remove from the queue", "error", err)
 	}
 }
 
-func (p *Pump) backoff(ctx context.Context, failureCount int) {
-	sleep := time.Duration(float64(time.Second) * math.Min(30, math.Pow(2., float64(failureCount))))
+func moveToDeadLetterQueue(q queue.Queue, qm queue.QueuedMessage, log *slog.Logger) {
+	if err := q.Dead(qm); err != nil {
+		log.Error("Unable to move to the dead-letter queue", "error", err)
+	}
+}
+
+// exhausted tells whether or not the attempt that just failed was the last
+// one allowed.
+func (p *Pump) exhausted(qm queue.QueuedMessage) bool {
+	return p.maxAttempts > 0 && qm.Attempts()+1 >= p.maxAttempts
+}
+
+func (p *Pump) backoff(ctx context.Context, failureCount int, fc FeedbackCollector) {
+	p.sleep(ctx, withJitter(backoffDelay(failureCount)), fc)
+}
+
+// backoffDelay returns the exponential back-off after the given number of
+// consecutive failures, capped at 30 seconds.
+func backoffDelay(failureCount int) time.Duration {
+	return time.Duration(float64(time.Second) * math.Min(30, math.Pow(2., float64(failureCount))))
+}
+
+// sleep pauses the worker, unless the pump is stopped in the meantime.
+func (p *Pump) sleep(ctx context.Context, sleep time.Duration, fc FeedbackCollector) {
 	p.adapter.Logger().Info("Backing off", "duration", sleep)
+	startedAt := time.Now()
 	ctx, cancel := context.WithTimeout(ctx, sleep)
 	defer cancel()
 	<-ctx.Done()
+	fc.CountBackoff(p.adapter.ID(), time.Since(startedAt))
 }
 
+// Serve runs the workers until the context is done, or until the pump is
+// drained. The number of workers can be changed in the meantime using
+// SetWorkers.
 func (p *Pump) Serve(ctx context.Context, q queue.Queue, fc FeedbackCollector) (err error) {
 	log := p.adapter.Logger()
+	p.lock.Lock()
+	if p.draining != nil {
+		// Drained before being served.
+		p.lock.Unlock()
+		return
+	}
+	ctx, p.stop = context.WithCancel(ctx)
+	p.stopped = make(chan struct{})
+	defer close(p.stopped)
+	p.serving = &serving{ctx: ctx, q: q, fc: fc}
+	err = p.scale(p.workers)
+	if err != nil {
+		p.scale(0)
+	}
+	p.lock.Unlock()
+	if err != nil {
+		p.wg.Wait()
+		return
+	}
+	var squasherDone chan struct{}
 	if p.squasher != nil {
-		p.wg.Add(1)
+		var client PumpClient
+		if client, err = p.adapter.NewClient(); err != nil {
+			p.lock.Lock()
+			p.scale(0)
+			p.lock.Unlock()
+			p.wg.Wait()
+			return
+		}
+		squasherDone = make(chan struct{})
 		go func() {
 			log.Info("Squasher started")
-			p.squasher.serve(fc)
+			p.squasher.serve(client, fc, func() error {
+				return p.waitResumed(ctx)
+			})
 			log.Info("Squasher stopped")
-			p.wg.Add(-1)
+			close(squasherDone)
 		}()
 	}
-	clients := make([]PumpClient, p.workers)
-	for i := 0; i < p.workers; i++ {
-		clients[i], err = p.adapter.NewClient()
-		if err != nil {
-			return
+	slog.Info("Workers started", "worker_count", p.Workers())
+	<-ctx.Done()
+	p.wg.Wait()
+	slog.Info("Workers stopped")
+	if p.squasher != nil {
+		p.lock.Lock()
+		flush, handingOver := p.draining, p.handingOver
+		p.lock.Unlock()
+		if flush == nil {
+			// Stopped without draining, nothing is flushed.
+			flush = ctx
 		}
+		p.squasher.requestShutdown(flush, handingOver)
+		<-squasherDone
 	}
+	return
+}
 
-	for i := 0; i < p.workers; i++ {
-		go func(client PumpClient) {
-			p.serveClient(ctx, q, client, fc)
-			if p.squasher != nil {
-				p.squasher.requestShutdown()
-			}
-		}(clients[i])
-		p.wg.Add(1)
-	}
-	slog.Info("Workers started", "worker_count", p.workers)
-	p.wg.Wait()
-	slog.Info("Workers stopped")
+// Drain stops the pump. The pushes in progress are finished, after which the
+// pending squash batches are flushed, until the context is done. Returns once
+// the pump stopped, or the context is done. Messages not pushed by then are
+// left in flight.
+func (p *Pump) Drain(ctx context.Context) error {
+	return p.drain(ctx, false)
+}
 
-	return
+// Handover stops the pump like Drain, except that the pending squash batches
+// are not flushed but left in the squash store, for the pump taking over the
+// service to send once they are due.
+func (p *Pump) Handover(ctx context.Context) error {
+	return p.drain(ctx, true)
+}
+
+func (p *Pump) drain(ctx context.Context, handover bool) error {
+	p.lock.Lock()
+	p.draining = ctx
+	p.handingOver = handover
+	stop, stopped := p.stop, p.stopped
+	p.lock.Unlock()
+	if stop == nil {
+		return nil
+	}
+	stop()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
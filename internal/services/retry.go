@@ -0,0 +1,103 @@
+package services
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRetryAfter caps the delays requested by upstream services, protecting
+// against bogus values.
+const maxRetryAfter = time.Hour
+
+// retryAfter is the delay requested by the upstream service before retrying.
+// The token is set in case the delay concerns the messages addressed to that
+// token only.
+type retryAfter struct {
+	delay time.Duration
+	token string
+}
+
+type retryAfterReporter interface {
+	reportRetryAfter(retry retryAfter)
+}
+
+// ReportRetryAfter is used by push services to pass on the delay requested by
+// the upstream service before retrying, e.g. through a `Retry-After` header.
+// If the delay concerns a single token, pass the token so that only the
+// messages addressed to it are held back. Otherwise, the worker pauses.
+func ReportRetryAfter(fc FeedbackCollector, delay time.Duration, token string) {
+	if delay <= 0 {
+		return
+	}
+	if r, ok := fc.(retryAfterReporter); ok {
+		r.reportRetryAfter(retryAfter{
+			delay: min(delay, maxRetryAfter),
+			token: token,
+		})
+	}
+}
+
+func (mc *messageCollector) reportRetryAfter(retry retryAfter) {
+	mc.retry = retry
+}
+
+// ParseRetryAfter parses the `Retry-After` header of the response, which holds
+// either a number of seconds or a date.
+func ParseRetryAfter(header http.Header, now time.Time) (delay time.Duration, ok bool) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now), true
+	}
+	return
+}
+
+// withJitter adds up to 10% to the duration, so that workers backing off at
+// the same moment do not all retry at the same moment as well.
+func withJitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
+
+// pauses keeps track of the tokens that the upstream service asked us to hold
+// back for a while.
+type pauses struct {
+	lock  sync.Mutex
+	until map[string]time.Time
+}
+
+func (ps *pauses) pause(token string, until time.Time) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if ps.until == nil {
+		ps.until = make(map[string]time.Time)
+	}
+	if len(ps.until) >= 1024 {
+		now := time.Now()
+		for t, u := range ps.until {
+			if !u.After(now) {
+				delete(ps.until, t)
+			}
+		}
+	}
+	ps.until[token] = until
+}
+
+func (ps *pauses) pausedUntil(token string, now time.Time) (until time.Time, paused bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	until, paused = ps.until[token]
+	if paused && !until.After(now) {
+		delete(ps.until, token)
+		paused = false
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 Jan 2024 11:00:00 GMT": 0,
+		"0":                             0,
+		"soon":                          0,
+		"":                              0,
+	} {
+		header := http.Header{}
+		header.Set("Retry-After", value)
+		delay, ok := ParseRetryAfter(header, now)
+		if delay != expected || ok != (expected > 0) {
+			t.Error(value, delay, ok)
+		}
+	}
+}
+
+type nopCollector struct {
+	FeedbackCollector
+}
+
+func TestRetryAfterToken(t *testing.T) {
+	// Every push is rejected, asking to hold back the token.
+	pushes := 0
+	adapter := &fakeAdapter{
+		id: "throttled",
+		push: func(msg tokenMessage, fc FeedbackCollector) PushStatus {
+			pushes++
+			ReportRetryAfter(fc, time.Hour, msg.Token)
+			return PushStatusTempFail
+		},
+	}
+	p := NewPump(PumpConfig{Workers: 1}, adapter)
+	q, err := memory.MemoryQueueFactory{}.NewQueue("throttled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{`{"token": "a"}`, `{"token": "a"}`, `{"token": "b"}`} {
+		if err = q.Queue([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var pushed []bool
+	for i := 0; i < 3; i++ {
+		qm, err := q.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, retry, ok := p.process(q, qm, nil, nopCollector{})
+		if ok && (status != PushStatusTempFail || retry.token == "") {
+			t.Fatal(status, retry)
+		}
+		pushed = append(pushed, ok)
+	}
+	// The second message to token "a" is held back, the message to token "b"
+	// is not.
+	if pushes != 2 || !pushed[0] || pushed[1] || !pushed[2] {
+		t.Fatal(pushes, pushed)
+	}
+	depth, err := q.Depth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth.Waiting != 2 || depth.Scheduled != 1 {
+		t.Fatal(depth)
+	}
+}
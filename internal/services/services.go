@@ -10,12 +10,36 @@ type FeedbackCollector interface {
 	TokenInvalid(serviceID, token string)
 	ReplaceToken(serviceID, token, replacement string)
 	CountPush(serviceID string, success bool, duration time.Duration)
+	// MessageExpired is called for messages that expired before they could
+	// be pushed. The token is empty for messages not addressed to a token.
+	MessageExpired(serviceID, token string)
+	// TrackMessage records the state of a message carrying a message ID.
+	TrackMessage(status MessageStatus)
+	// CountBackoff records the time spent backing off after a failure.
+	CountBackoff(serviceID string, duration time.Duration)
+	// CountThrottle records the time spent waiting for the rate limit of a
+	// service.
+	CountThrottle(serviceID string, duration time.Duration)
+	// CountSquash records a message being squashed, and the number of
+	// batches pending as a result.
+	CountSquash(serviceID string, pendingBatches int)
+	// CountSquashBatch records a batch of squashed messages being pushed,
+	// and the number of batches still pending.
+	CountSquashBatch(serviceID string, size int, pendingBatches int)
+	// BreakerStateChanged is called whenever the circuit breaker of a
+	// service changes state.
+	BreakerStateChanged(serviceID string, state BreakerState)
+}
+
+// TokenMessage is implemented by service messages that are addressed to a
+// token, as communicated back through feedback.
+type TokenMessage interface {
+	GetToken() string
 }
 
 // PushService ...
 type PushService interface {
 	PumpAdapter
 	fmt.Stringer
-	ID() string
 	Validate([]byte) error
 }
@@ -1,182 +1,314 @@
 package services
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"codeberg.org/pennersr/shove/internal/queue"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type batch struct {
-	key         string
-	serviceMsgs []ServiceMessage
-	due         time.Time
-	queuedMsgs  []queue.QueuedMessage
-	q           queue.Queue
-	client      PumpClient
-}
-
 type SquashConfig struct {
 	RateMax int
 	RatePer time.Duration
+	// Store keeps track of the rates and the pending batches, and is
+	// required when squashing.
+	Store queue.SquashStore
 }
 
+// flushAll is the time by which all batches are due, used to flush them when
+// shutting down.
+var flushAll = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxSquashPoll is the maximum interval at which the store is checked for due
+// batches, as other Shove instances may add batches to a shared store.
+const maxSquashPoll = 500 * time.Millisecond
+
 type squasher struct {
-	pushedAt     map[string][]time.Time
-	batches      map[string]batch
-	config       SquashConfig
-	cond         *sync.Cond
+	config      SquashConfig
+	store       queue.SquashStore
+	maxAttempts int
+	adapter     PumpAdapter
+	// limiter is the rate limit of the pump, which batches are subject to
+	// as well.
+	limiter *limiter
+	// wake is signalled when a message is squashed.
+	wake         chan struct{}
 	lock         sync.Mutex
 	shuttingDown bool
-	adapter      PumpAdapter
+	// handingOver is set when shutting down while another squasher takes
+	// over the store.
+	handingOver bool
+	// flush is done once pending batches are no longer to be flushed when
+	// shutting down.
+	flush context.Context
+	// stop is closed when shutting down.
+	stop chan struct{}
 }
 
-func newSquasher(config SquashConfig, adapter PumpAdapter) (d *squasher) {
+func newSquasher(config SquashConfig, maxAttempts int, adapter PumpAdapter) (d *squasher) {
 	d = new(squasher)
 	d.adapter = adapter
 	d.config = config
-	d.pushedAt = make(map[string][]time.Time)
-	d.batches = make(map[string]batch)
-	d.cond = sync.NewCond(&d.lock)
+	d.maxAttempts = maxAttempts
+	d.store = config.Store
+	if d.store == nil {
+		panic("squash store required")
+	}
+	d.wake = make(chan struct{}, 1)
+	d.stop = make(chan struct{})
 	return d
 }
 
-func (d *squasher) flushAndGetRate(key string) (sendCount int, sentAt time.Time) {
-	var flushedTimes []time.Time
-	times := d.pushedAt[key]
-	var didFlush = false
-	for _, t := range times {
-		if time.Since(t) > d.config.RatePer {
-			didFlush = true
-			continue
-		}
-		flushedTimes = append(flushedTimes, t)
-		sendCount++
-	}
-	if didFlush {
-		d.pushedAt[key] = flushedTimes
+// prepareToPush records the push of the message to the squash key, unless the
+// rate is exceeded, in which case the message is squashed instead.
+func (d *squasher) prepareToPush(q queue.Queue, qm queue.QueuedMessage, key string, fc FeedbackCollector) (squashed bool) {
+	log := d.adapter.Logger()
+	acquired, freeAt, err := d.store.Acquire(key, d.config.RateMax, d.config.RatePer)
+	if err != nil {
+		log.Error("Unable to determine rate, not squashing", "error", err)
+		return false
 	}
-	if len(flushedTimes) > 0 {
-		sentAt = flushedTimes[0]
+	if acquired {
+		return false
 	}
-	return
-}
-
-func (d *squasher) recordPush(key string) {
-	times := d.pushedAt[key]
-	times = append(times, time.Now())
-	d.pushedAt[key] = times
-}
-
-func (d *squasher) prepareToPush(q queue.Queue, qm queue.QueuedMessage, client PumpClient, smsg ServiceMessage) (squashed bool) {
-	d.cond.L.Lock()
-	defer d.cond.L.Unlock()
-
-	key := smsg.GetSquashKey()
-	sendCount, firstSendAt := d.flushAndGetRate(key)
-	if sendCount < d.config.RateMax {
-		d.recordPush(key)
+	if err = d.store.Squash(q, qm, key, freeAt); err != nil {
+		log.Error("Unable to squash", "error", err)
 		return false
 	}
-	d.adapter.Logger().Info("Rate exceeded, squashed", "destination", key)
-
-	batch, ok := d.batches[key]
-	if ok {
-		if batch.q != q {
-			panic("squasher cannot handle mixed queues")
-		}
-	} else {
-		batch.q = q
-		batch.client = client
-	}
-	batch.key = key
-	batch.serviceMsgs = append(batch.serviceMsgs, smsg)
-	batch.queuedMsgs = append(batch.queuedMsgs, qm)
-	batch.due = firstSendAt.Add(d.config.RatePer)
-	d.batches[key] = batch
-	d.cond.Signal()
+	log.Info("Rate exceeded, squashed", "destination", key)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	pending, _ := d.store.Pending()
+	fc.CountSquash(d.adapter.ID(), pending)
 	return true
 }
 
-func (d *squasher) getNextBatch() (b batch, stopped bool) {
+// nextBatch waits for a batch to become due. When shutting down, the pending
+// batches are flushed right away, unless the store is persistent.
+func (d *squasher) nextBatch() (b *queue.SquashedBatch, stopped bool) {
 	for {
-		d.cond.L.Lock()
-		if len(d.batches) == 0 {
-			d.cond.Wait()
+		d.lock.Lock()
+		shuttingDown, flush := d.shuttingDown, d.flush
+		d.lock.Unlock()
+		by := time.Now()
+		if shuttingDown {
+			if d.keepsBatches() || flush.Err() != nil {
+				stopped = true
+				return
+			}
+			by = flushAll
 		}
-		if d.shuttingDown {
-			d.cond.L.Unlock()
+		var next time.Time
+		var err error
+		b, next, err = d.store.Take(by)
+		if err != nil {
+			d.adapter.Logger().Error("Unable to take batch", "error", err)
+		} else if b != nil {
+			return b, false
+		}
+		if shuttingDown {
 			stopped = true
 			return
 		}
-		var minDueBatch batch
-		var minDueBatchKey string
-		for key, batch := range d.batches {
-			if minDueBatch.due.IsZero() || minDueBatch.due.After(batch.due) {
-				minDueBatch = batch
-				minDueBatchKey = key
-			}
+		wait := maxSquashPoll
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
 		}
-		now := time.Now()
-		if now.After(minDueBatch.due) {
-			delete(d.batches, minDueBatchKey)
-			d.cond.L.Unlock()
-			return minDueBatch, false
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.wake:
+		case <-d.stop:
+		case <-timer.C:
 		}
-		d.cond.L.Unlock()
+		timer.Stop()
+	}
+}
 
-		zzz := minDueBatch.due.Sub(now)
-		maxZzz := time.Millisecond * 500
-		if zzz > maxZzz {
-			zzz = maxZzz
-		}
-		time.Sleep(zzz)
+// requestShutdown stops the squasher once the pending batches are flushed, or
+// once the flush context is done, whichever comes first. Messages of batches
+// not flushed are left in flight. When handing over, the batches are not
+// flushed but left in the store.
+func (d *squasher) requestShutdown(flush context.Context, handover bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.shuttingDown {
+		d.shuttingDown = true
+		d.handingOver = handover
+		d.flush = flush
+		close(d.stop)
 	}
 }
 
-func (d *squasher) requestShutdown() {
-	d.cond.L.Lock()
-	d.shuttingDown = true
-	d.cond.Signal()
-	d.cond.L.Unlock()
+// keepsBatches returns whether or not the pending batches outlive the
+// squasher, in which case they need not be flushed when shutting down.
+func (d *squasher) keepsBatches() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.handingOver || d.store.Persistent()
 }
 
 func (d *squasher) shutdown() {
-	d.cond.L.Lock()
-	defer d.cond.L.Unlock()
-
-	d.adapter.Logger().Info("Shutting down squasher", "unsent_batch_count", len(d.batches))
+	pending, _ := d.store.Pending()
+	if pending > 0 && !d.keepsBatches() {
+		d.adapter.Logger().Warn("Shutting down squasher, leaving unsent batches in flight", "unsent_batch_count", pending)
+		return
+	}
+	d.adapter.Logger().Info("Shutting down squasher", "unsent_batch_count", pending)
 }
 
-func (d *squasher) serve(fc FeedbackCollector) {
+// serve sends the batches as they become due. The resumed function blocks
+// while the pump is paused.
+func (d *squasher) serve(client PumpClient, fc FeedbackCollector, resumed func() error) {
 	for {
-		batch, stopped := d.getNextBatch()
+		batch, stopped := d.nextBatch()
+		if !stopped && resumed() != nil {
+			// Stopped while paused, the batch is put back as is.
+			if err := d.store.Retry(batch, time.Now()); err != nil {
+				d.adapter.Logger().Error("Unable to put back batch", "error", err)
+			}
+			stopped = true
+		}
 		if stopped {
 			d.shutdown()
 			return
 		}
-		d.sendBatch(batch, fc)
-
+		d.sendBatch(client, batch, fc)
 	}
 }
 
-func (d *squasher) sendBatch(b batch, fc FeedbackCollector) {
-	d.adapter.Logger().Info("Sending batch", "batch_size", len(b.serviceMsgs))
-	d.cond.L.Lock()
-	d.recordPush(b.key)
-	d.cond.L.Unlock()
+// expiredMessage is a message of a batch that expired before the batch could
+// be pushed.
+type expiredMessage struct {
+	messageID string
+	token     string
+}
 
-	status := d.adapter.SquashAndPushMessage(b.client, b.serviceMsgs, fc)
+func (d *squasher) sendBatch(client PumpClient, b *queue.SquashedBatch, fc FeedbackCollector) {
+	log := d.adapter.Logger()
+	now := time.Now()
+	smsgs := make([]ServiceMessage, 0, len(b.Messages))
+	messageIDs := make([]string, 0, len(b.Messages))
+	var expired []expiredMessage
+	var links []trace.Link
+	for _, msg := range b.Messages {
+		// Messages are validated before being squashed.
+		smsg, err := d.adapter.ConvertMessage(msg)
+		if err != nil {
+			log.Error("Bad message", "error", err)
+			continue
+		}
+		env, _ := ParseEnvelope(msg)
+		if env.Expired(now) {
+			// Left out of every attempt, expired messages are only
+			// reported once the batch is done with, as the store keeps
+			// them along with the batch.
+			em := expiredMessage{messageID: env.MessageID}
+			if tmsg, ok := smsg.(TokenMessage); ok {
+				em.token = tmsg.GetToken()
+			}
+			expired = append(expired, em)
+			continue
+		}
+		smsgs = append(smsgs, smsg)
+		messageIDs = append(messageIDs, env.MessageID)
+		if link := trace.LinkFromContext(ExtractTraceContext(context.Background(), env)); link.SpanContext.IsValid() {
+			links = append(links, link)
+		}
+	}
+	if len(smsgs) == 0 && len(expired) > 0 {
+		log.Info("Expired batch", "batch_size", len(b.Messages))
+		d.expire(expired, fc, b.Failures)
+		if err := d.store.Done(b, now); err != nil {
+			log.Error("Unable to remove from the queue", "error", err)
+		}
+		return
+	}
+
+	log.Info("Sending batch", "batch_size", len(smsgs))
+	if err := d.store.Record(b.Key, d.config.RatePer); err != nil {
+		log.Error("Unable to record push", "error", err)
+	}
+	pending, _ := d.store.Pending()
+	fc.CountSquashBatch(d.adapter.ID(), len(smsgs), pending)
+
+	ctx, span := tracer.Start(context.Background(), "squash "+d.adapter.ID(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("shove.service", d.adapter.ID()),
+			attribute.Int("shove.batch_size", len(smsgs)),
+		),
+	)
+	defer span.End()
+	throttle(ctx, d.limiter, d.adapter, fc)
+	mc := &messageCollector{FeedbackCollector: fc}
+	status := d.adapter.SquashAndPushMessage(ctx, client, smsgs, mc)
+	if status != PushStatusSuccess {
+		span.SetStatus(codes.Error, mc.details)
+	}
+	for _, messageID := range messageIDs {
+		track(fc, d.adapter, messageID, status.messageState(), mc.details, b.Failures+1)
+	}
+	// Messages squashed in the meantime are due once the rate allows.
+	next := time.Now().Add(d.config.RatePer)
 	switch status {
 	case PushStatusTempFail:
-		// TODO: We should actually attempt to retry this with a backoff
-		fallthrough
+		b.Failures++
+		if d.maxAttempts > 0 && b.Failures >= d.maxAttempts {
+			log.Error("Giving up on batch, maximum attempts reached", "attempts", b.Failures)
+			if err := d.store.Dead(b, next); err != nil {
+				log.Error("Unable to move to the dead-letter queue", "error", err)
+			}
+			for _, messageID := range messageIDs {
+				track(fc, d.adapter, messageID, MessageDead, "maximum attempts reached", b.Failures)
+			}
+			d.expire(expired, fc, b.Failures)
+			return
+		}
+		delay := mc.retry.delay
+		if delay == 0 {
+			delay = backoffDelay(b.Failures - 1)
+		}
+		d.retry(b, time.Now().Add(withJitter(delay)))
 	case PushStatusHardFail:
-		d.adapter.Logger().Error("Failed to send batch")
+		log.Error("Failed to send batch")
 		fallthrough
 	case PushStatusSuccess:
-		for _, qm := range b.queuedMsgs {
-			removeFromQueue(b.q, qm, d.adapter.Logger())
+		if err := d.store.Done(b, next); err != nil {
+			log.Error("Unable to remove from the queue", "error", err)
 		}
+		d.expire(expired, fc, b.Failures)
+	}
+}
+
+// expire reports the expired messages of a batch that is done with.
+func (d *squasher) expire(expired []expiredMessage, fc FeedbackCollector, attempts int) {
+	for _, em := range expired {
+		fc.MessageExpired(d.adapter.ID(), em.token)
+		track(fc, d.adapter, em.messageID, MessageExpired, "", attempts)
+	}
+}
+
+// retry puts the batch back, to be pushed again once due. Its messages stay
+// queued in the meantime. Messages squashed since are pushed along with it.
+func (d *squasher) retry(b *queue.SquashedBatch, due time.Time) {
+	log := d.adapter.Logger()
+	d.lock.Lock()
+	shuttingDown := d.shuttingDown
+	d.lock.Unlock()
+	if shuttingDown && !d.keepsBatches() {
+		// Not retried while draining, the messages are left in flight.
+		log.Warn("Failed to send batch, leaving it in flight", "batch_size", len(b.Messages))
+		return
+	}
+	log.Info("Failed to send batch, retrying", "batch_size", len(b.Messages), "due", due)
+	if err := d.store.Retry(b, due); err != nil {
+		log.Error("Unable to retry batch", "error", err)
 	}
 }
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue"
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+)
+
+// flakyBatchAdapter returns an adapter that fails to push batches the given
+// number of times, asking to retry shortly. The size of every batch is sent to
+// the channel.
+func flakyBatchAdapter(failures int, batches chan int) *fakeAdapter {
+	return &fakeAdapter{
+		id: "flaky",
+		squash: func(msgs []tokenMessage, fc FeedbackCollector) PushStatus {
+			batches <- len(msgs)
+			if failures > 0 {
+				failures--
+				ReportRetryAfter(fc, 10*time.Millisecond, "")
+				return PushStatusTempFail
+			}
+			return PushStatusSuccess
+		},
+	}
+}
+
+func squashBatch(t *testing.T, adapter *fakeAdapter, maxAttempts int) queue.Queue {
+	d := newSquasher(SquashConfig{RateMax: 1, RatePer: 50 * time.Millisecond, Store: memory.NewSquashStore()}, maxAttempts, adapter)
+	q, err := memory.MemoryQueueFactory{}.NewQueue("flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err = q.Queue([]byte(`{"token": "a"}`)); err != nil {
+			t.Fatal(err)
+		}
+		qm, _ := q.Get(ctx)
+		if d.prepareToPush(q, qm, "a", squashCollector{}) {
+			continue
+		}
+		removeFromQueue(q, qm, adapter.Logger())
+	}
+	go d.serve(nil, squashCollector{}, func() error { return nil })
+	t.Cleanup(func() {
+		d.requestShutdown(ctx, false)
+	})
+	return q
+}
+
+func TestBatchRetry(t *testing.T) {
+	batches := make(chan int, 10)
+	adapter := flakyBatchAdapter(2, batches)
+	q := squashBatch(t, adapter, 0)
+	for i := 0; i < 3; i++ {
+		select {
+		case size := <-batches:
+			if size != 2 {
+				t.Fatal(size)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("batch not retried")
+		}
+	}
+	// Removed from the queue once pushed.
+	for {
+		depth, _ := q.Depth()
+		if depth.InFlight == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBatchRetryExhausted(t *testing.T) {
+	batches := make(chan int, 10)
+	adapter := flakyBatchAdapter(10, batches)
+	q := squashBatch(t, adapter, 2)
+	for {
+		depth, _ := q.Depth()
+		if depth.Dead == 2 {
+			if depth.InFlight != 0 || len(batches) != 2 {
+				t.Fatal(depth, len(batches))
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSquashOptions(t *testing.T) {
+	pushed := make(chan string, 10)
+	adapter := countingAdapter(pushed)
+	p := NewPump(PumpConfig{
+		Workers: 1,
+		Squash:  SquashConfig{RateMax: 1, RatePer: time.Hour, Store: memory.NewSquashStore()},
+	}, adapter)
+	q, err := memory.MemoryQueueFactory{}.NewQueue("counting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		msg    string
+		pushed bool
+	}{
+		{`{"token": "a"}`, true},
+		{`{"token": "a"}`, false},
+		{`{"token": "a", "squash": {"disable": true}}`, true},
+		{`{"token": "a", "squash": {"key": "thread"}}`, true},
+		{`{"token": "a", "squash": {"key": "thread"}}`, false},
+		{`{"token": "b", "squash": {"key": "thread"}}`, true},
+	} {
+		if err = q.Queue([]byte(c.msg)); err != nil {
+			t.Fatal(err)
+		}
+		qm, err := q.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, pushed := p.process(q, qm, nil, squashCollector{}); pushed != c.pushed {
+			t.Fatal(c.msg, pushed)
+		}
+	}
+	if pending, _ := p.squasher.store.Pending(); pending != 2 {
+		t.Fatal(pending)
+	}
+}
+
+type expiryCollector struct {
+	squashCollector
+	expired chan string
+}
+
+func (ec expiryCollector) MessageExpired(serviceID, token string) {
+	ec.expired <- token
+}
+
+func (ec expiryCollector) TrackMessage(status MessageStatus) {
+}
+
+func TestBatchExpiry(t *testing.T) {
+	batches := make(chan int, 10)
+	adapter := flakyBatchAdapter(1, batches)
+	d := newSquasher(SquashConfig{RateMax: 1, RatePer: 50 * time.Millisecond, Store: memory.NewSquashStore()}, 0, adapter)
+	q, err := memory.MemoryQueueFactory{}.NewQueue("flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := expiryCollector{expired: make(chan string, 10)}
+	ctx := context.Background()
+	for _, msg := range []string{
+		`{"token": "a"}`,
+		`{"token": "a"}`,
+		`{"token": "b", "expires_at": "2000-01-01T00:00:00Z"}`,
+	} {
+		if err = q.Queue([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		qm, _ := q.Get(ctx)
+		if d.prepareToPush(q, qm, "a", fc) {
+			continue
+		}
+		removeFromQueue(q, qm, adapter.Logger())
+	}
+	go d.serve(nil, fc, func() error { return nil })
+	defer d.requestShutdown(ctx, false)
+
+	// The expired message is left out of both attempts, and reported once.
+	for i := 0; i < 2; i++ {
+		select {
+		case size := <-batches:
+			if size != 1 {
+				t.Fatal(size)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("batch not pushed")
+		}
+	}
+	select {
+	case token := <-fc.expired:
+		if token != "b" {
+			t.Fatal(token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expiry not reported")
+	}
+	for {
+		depth, _ := q.Depth()
+		if depth.InFlight == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(fc.expired) != 0 {
+		t.Fatal("expiry reported twice")
+	}
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"time"
+)
+
+// MessageState ...
+type MessageState string
+
+const (
+	MessageQueued     MessageState = "queued"
+	MessageSending    MessageState = "sending"
+	MessageDelivered  MessageState = "delivered"
+	MessageTempFailed MessageState = "temp-failed"
+	MessageHardFailed MessageState = "hard-failed"
+	MessageSquashed   MessageState = "squashed"
+	MessageExpired    MessageState = "expired"
+	MessageDead       MessageState = "dead"
+)
+
+// MessageStatus describes where a message is in its lifecycle.
+type MessageStatus struct {
+	ID      string       `json:"id"`
+	Service string       `json:"service"`
+	State   MessageState `json:"state"`
+	// Details holds the upstream response, e.g. the reason for rejection.
+	Details   string    `json:"details,omitempty"`
+	Attempts  int       `json:"attempts"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type detailsReporter interface {
+	reportDetails(details string)
+}
+
+// ReportDetails is used by push services to report the details of the
+// upstream response to the message being pushed.
+func ReportDetails(fc FeedbackCollector, details string) {
+	if r, ok := fc.(detailsReporter); ok {
+		r.reportDetails(details)
+	}
+}
+
+// messageCollector wraps the feedback collector while pushing a single
+// message, capturing the details and the retry delay reported.
+type messageCollector struct {
+	FeedbackCollector
+	details string
+	retry   retryAfter
+}
+
+func (mc *messageCollector) reportDetails(details string) {
+	mc.details = details
+}
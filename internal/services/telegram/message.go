@@ -29,6 +29,10 @@ func (msg telegramMessage) GetSquashKey() string {
 	return msg.parsedPayload.ChatID
 }
 
+func (msg telegramMessage) GetToken() string {
+	return msg.parsedPayload.ChatID
+}
+
 func (tg *TelegramService) ConvertMessage(data []byte) (services.ServiceMessage, error) {
 	var msg telegramMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
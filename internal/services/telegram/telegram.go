@@ -2,6 +2,7 @@ package telegram
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"golang.org/x/exp/slog"
@@ -12,16 +13,33 @@ import (
 	"codeberg.org/pennersr/shove/internal/services"
 )
 
+// Config ...
+type Config struct {
+	// ID identifies the service, defaulting to "telegram".
+	ID       string
+	BotToken string
+}
+
 // TelegramService ...
 type TelegramService struct {
+	id       string
 	botToken string
 	log      *slog.Logger
 }
 
 // NewTelegramService ...
 func NewTelegramService(botToken string, log *slog.Logger) (tg *TelegramService, err error) {
+	return NewTelegramServiceWithConfig(Config{BotToken: botToken}, log)
+}
+
+// NewTelegramServiceWithConfig ...
+func NewTelegramServiceWithConfig(config Config, log *slog.Logger) (tg *TelegramService, err error) {
+	if config.ID == "" {
+		config.ID = "telegram"
+	}
 	tg = &TelegramService{
-		botToken: botToken,
+		id:       config.ID,
+		botToken: config.BotToken,
 		log:      log,
 	}
 	return
@@ -33,12 +51,14 @@ func (tg *TelegramService) Logger() *slog.Logger {
 
 // ID ...
 func (tg *TelegramService) ID() string {
-	return "telegram"
-
+	return tg.id
 }
 
 // String ...
 func (tg *TelegramService) String() string {
+	if tg.id != "telegram" {
+		return "Telegram (" + tg.id + ")"
+	}
 	return "Telegram"
 }
 
@@ -49,7 +69,7 @@ func (tg *TelegramService) NewClient() (services.PumpClient, error) {
 	return client, nil
 }
 
-func (tg *TelegramService) SquashAndPushMessage(pclient services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (tg *TelegramService) SquashAndPushMessage(ctx context.Context, pclient services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
 	client := pclient.(*http.Client)
 	msgs := make([]telegramMessage, len(smsgs))
 	for i, smsg := range smsgs {
@@ -60,29 +80,33 @@ func (tg *TelegramService) SquashAndPushMessage(pclient services.PumpClient, sms
 		tg.log.Error("Squashing failed", "error", err)
 		return services.PushStatusHardFail
 	}
-	return tg.pushMessage(client, dmsg.Method, dmsg.parsedPayload.ChatID, dmsg.Payload, fc)
+	return tg.pushMessage(ctx, client, dmsg.Method, dmsg.parsedPayload.ChatID, dmsg.Payload, fc)
 }
 
-func (tg *TelegramService) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (tg *TelegramService) PushMessage(ctx context.Context, pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) (status services.PushStatus) {
 	client := pclient.(*http.Client)
 	msg := smsg.(telegramMessage)
-	return tg.pushMessage(client, msg.Method, msg.parsedPayload.ChatID, msg.Payload, fc)
+	return tg.pushMessage(ctx, client, msg.Method, msg.parsedPayload.ChatID, msg.Payload, fc)
 }
 
-func (tg *TelegramService) pushMessage(client *http.Client, method string, chatID string, payload json.RawMessage, fc services.FeedbackCollector) (status services.PushStatus) {
+func (tg *TelegramService) pushMessage(ctx context.Context, client *http.Client, method string, chatID string, payload json.RawMessage, fc services.FeedbackCollector) (status services.PushStatus) {
 	startedAt := time.Now()
 	var success bool
 
 	url := fmt.Sprintf("https://api.telegram.org/bot%s/%s", tg.botToken, method)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	ctx, span := services.StartSpan(ctx, tg, "Telegram "+method)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payload))
 	if err != nil {
+		services.EndSpan(span, err)
 		tg.log.Error("Failure creating request", "error", err)
 		return services.PushStatusHardFail
 	}
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := client.Do(req)
+	services.EndHTTPSpan(span, resp, err)
 	if err != nil {
 		tg.log.Error("Posting failed", "error", err)
+		services.ReportDetails(fc, err.Error())
 		return services.PushStatusTempFail
 	}
 	duration := time.Now().Sub(startedAt)
@@ -93,22 +117,34 @@ func (tg *TelegramService) pushMessage(client *http.Client, method string, chatI
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 429 {
-		tg.log.Error("Throttled, too many requests", "status", 429)
-		return services.PushStatusTempFail
-	}
-
 	var respData struct {
 		OK          bool   `json:"ok"`
 		ErrorCode   int    `json:"error_code"`
 		Description string `json:"description"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+
+	if resp.StatusCode == 429 {
+		tg.log.Error("Throttled, too many requests", "status", 429)
+		services.ReportDetails(fc, http.StatusText(resp.StatusCode))
+		// The flood control limits are per bot, so all chats are held back.
+		if json.NewDecoder(resp.Body).Decode(&respData) == nil && respData.Parameters.RetryAfter > 0 {
+			services.ReportRetryAfter(fc, time.Duration(respData.Parameters.RetryAfter)*time.Second, "")
+		} else if delay, ok := services.ParseRetryAfter(resp.Header, time.Now()); ok {
+			services.ReportRetryAfter(fc, delay, "")
+		}
+		return services.PushStatusTempFail
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&respData)
 	if err != nil {
 		tg.log.Error("Unable to decode response", "error", err)
+		services.ReportDetails(fc, err.Error())
 		return services.PushStatusTempFail
 	}
+	services.ReportDetails(fc, respData.Description)
 
 	// It's a bit odd that an invalid chat ID results in a 400 instead of a
 	// special response code {"ok":false,"error_code":400,"description":"Bad
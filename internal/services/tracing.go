@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName identifies the spans started by Shove.
+const TracerName = "codeberg.org/pennersr/shove"
+
+var tracer = otel.Tracer(TracerName)
+
+// InjectTraceContext returns the trace context of the span in the context, in
+// a form that can be stored in the envelope of a message.
+func InjectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// ExtractTraceContext returns a context holding the trace context stored in the
+// envelope, so that the trace started when the message was pushed can resume.
+func ExtractTraceContext(ctx context.Context, env Envelope) context.Context {
+	if len(env.TraceContext) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(env.TraceContext))
+}
+
+// StartSpan starts a span around a call to the upstream service.
+func StartSpan(ctx context.Context, adapter PumpAdapter, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("shove.service", adapter.ID())),
+	)
+}
+
+// EndSpan ends the span, recording the error, if any.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// EndHTTPSpan ends a span around an HTTP request to the upstream service,
+// recording the response status.
+func EndHTTPSpan(span trace.Span, resp *http.Response, err error) {
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if err == nil && resp.StatusCode >= 400 {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	EndSpan(span, err)
+}
+
+// InjectHTTPHeaders propagates the trace context to the upstream service.
+func InjectHTTPHeaders(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	msg, err := AssignTraceContext([]byte(`{"token": "abc"}`), InjectTraceContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := ParseEnvelope(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted := trace.SpanContextFromContext(ExtractTraceContext(context.Background(), env))
+	if extracted.TraceID() != sc.TraceID() || extracted.SpanID() != sc.SpanID() || !extracted.IsRemote() {
+		t.Fatal(extracted)
+	}
+}
@@ -2,6 +2,7 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"time"
@@ -10,13 +11,33 @@ import (
 	"golang.org/x/exp/slog"
 )
 
+// Config ...
+type Config struct {
+	// ID identifies the service, defaulting to "webhook".
+	ID string
+	// Retry considers upstream failures (connection errors, 5xx responses)
+	// to be temporary, so that they are retried. Only enable this in
+	// combination with a limited number of attempts.
+	Retry bool
+}
+
 type Webhook struct {
-	log *slog.Logger
+	log    *slog.Logger
+	config Config
 }
 
 func NewWebhook(log *slog.Logger) (fcm *Webhook, err error) {
-	fcm = &Webhook{
-		log: log,
+	return NewWebhookWithConfig(Config{}, log)
+}
+
+// NewWebhookWithConfig ...
+func NewWebhookWithConfig(config Config, log *slog.Logger) (wh *Webhook, err error) {
+	if config.ID == "" {
+		config.ID = "webhook"
+	}
+	wh = &Webhook{
+		log:    log,
+		config: config,
 	}
 	return
 }
@@ -27,11 +48,14 @@ func (fcm *Webhook) Logger() *slog.Logger {
 
 // ID ...
 func (fcm *Webhook) ID() string {
-	return "webhook"
+	return fcm.config.ID
 }
 
 // String ...
 func (fcm *Webhook) String() string {
+	if fcm.config.ID != "webhook" {
+		return "Webhook (" + fcm.config.ID + ")"
+	}
 	return "Webhook"
 }
 
@@ -46,30 +70,35 @@ func (fcm *Webhook) NewClient() (services.PumpClient, error) {
 	return client, nil
 }
 
-func (wh *Webhook) SquashAndPushMessage(services.PumpClient, []services.ServiceMessage, services.FeedbackCollector) services.PushStatus {
+func (wh *Webhook) SquashAndPushMessage(context.Context, services.PumpClient, []services.ServiceMessage, services.FeedbackCollector) services.PushStatus {
 	panic("not implemented")
 }
 
-func (wh *Webhook) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (wh *Webhook) PushMessage(ctx context.Context, pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
 	msg := smsg.(webhookMessage)
 	startedAt := time.Now()
 	var success bool
 
 	wh.log.Debug("POST", "url", msg.URL, "data", string(msg.postData))
-	req, err := http.NewRequest("POST", msg.URL, bytes.NewBuffer(msg.postData))
+	ctx, span := services.StartSpan(ctx, wh, "Webhook POST")
+	req, err := http.NewRequestWithContext(ctx, "POST", msg.URL, bytes.NewBuffer(msg.postData))
 	if err != nil {
+		services.EndSpan(span, err)
 		wh.log.Error("Failed to create request", "error", err)
 		return services.PushStatusHardFail
 	}
 	for k, v := range msg.Headers {
 		req.Header.Set(k, v)
 	}
+	services.InjectHTTPHeaders(ctx, req.Header)
 
 	client := pclient.(*http.Client)
 	resp, err := client.Do(req)
+	services.EndHTTPSpan(span, resp, err)
 	if err != nil {
 		wh.log.Error("Failed to post", "error", err)
-		return services.PushStatusHardFail
+		services.ReportDetails(fc, err.Error())
+		return wh.upstreamFailure()
 	}
 	duration := time.Now().Sub(startedAt)
 
@@ -85,17 +114,25 @@ func (wh *Webhook) PushMessage(pclient services.PumpClient, smsg services.Servic
 	}
 
 	defer resp.Body.Close()
+	services.ReportDetails(fc, resp.Status)
 	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
 		wh.log.Error("Rejected", "status", resp.StatusCode)
 		return services.PushStatusHardFail
 	}
 	if resp.StatusCode >= 500 && resp.StatusCode < 600 {
 		wh.log.Error("Upstream failure", "status", resp.StatusCode)
-		// A retry might help, but currently retries are not limitted to
-		// a certain number of attempts, meaning, we would keep trying
-		// indefinitely.
-		return services.PushStatusHardFail
+		return wh.upstreamFailure()
 	}
 	success = true
 	return services.PushStatusSuccess
 }
+
+// upstreamFailure returns the status of pushes failing due to the upstream. A
+// retry might help, but unless retries are limited to a certain number of
+// attempts, we would keep trying indefinitely.
+func (wh *Webhook) upstreamFailure() services.PushStatus {
+	if wh.config.Retry {
+		return services.PushStatusTempFail
+	}
+	return services.PushStatusHardFail
+}
@@ -4,6 +4,7 @@ import (
 	"codeberg.org/pennersr/shove/internal/services"
 	"encoding/json"
 	wpg "github.com/SherClockHolmes/webpush-go"
+	"time"
 )
 
 type webPushMessage struct {
@@ -24,6 +25,10 @@ func (msg webPushMessage) GetSquashKey() string {
 	panic("not implemented")
 }
 
+func (msg webPushMessage) GetToken() string {
+	return msg.Token
+}
+
 func (wp *WebPush) ConvertMessage(data []byte) (services.ServiceMessage, error) {
 	var msg webPushMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
@@ -45,6 +50,14 @@ func (wp *WebPush) ConvertMessage(data []byte) (services.ServiceMessage, error)
 	}
 	if msg.Headers.TTL > 0 {
 		msg.options.TTL = msg.Headers.TTL
+	} else {
+		env, err := services.ParseEnvelope(data)
+		if err != nil {
+			return nil, err
+		}
+		if env.ExpiresAt != nil {
+			msg.options.TTL = max(int(time.Until(*env.ExpiresAt).Seconds()), 0)
+		}
 	}
 	return msg, nil
 }
@@ -5,6 +5,7 @@ import (
 	"golang.org/x/exp/slog"
 	"os"
 	"testing"
+	"time"
 )
 
 const subscription = `{
@@ -68,3 +69,26 @@ func TestConvertWithToken(t *testing.T) {
 		t.Fatal(msg.Token)
 	}
 }
+
+func TestConvertWithExpiry(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	wp, err := NewWebPush("pub", "pvt", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	smsg, err := wp.ConvertMessage([]byte(fmt.Sprintf(`
+{
+	"subscription": %s,
+	"expires_at": "%s",
+	"payload": {"xxx":"z"}
+}
+`, subscription, expiresAt)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := smsg.(webPushMessage)
+	if msg.options.TTL < 3590 || msg.options.TTL > 3600 {
+		t.Fatal(msg.options.TTL)
+	}
+}
@@ -3,14 +3,24 @@ package webpush
 import (
 	"codeberg.org/pennersr/shove/internal/queue"
 	"codeberg.org/pennersr/shove/internal/services"
+	"context"
 	wpg "github.com/SherClockHolmes/webpush-go"
 	"golang.org/x/exp/slog"
 	"net/http"
 	"time"
 )
 
+// Config ...
+type Config struct {
+	// ID identifies the service, defaulting to "webpush".
+	ID              string
+	VAPIDPublicKey  string
+	VAPIDPrivateKey string
+}
+
 // WebPush ...
 type WebPush struct {
+	id              string
 	vapidPublicKey  string
 	vapidPrivateKey string
 	log             *slog.Logger
@@ -18,9 +28,21 @@ type WebPush struct {
 
 // NewWebPush ...
 func NewWebPush(vapidPub, vapidPvt string, log *slog.Logger) (wp *WebPush, err error) {
+	return NewWebPushWithConfig(Config{
+		VAPIDPublicKey:  vapidPub,
+		VAPIDPrivateKey: vapidPvt,
+	}, log)
+}
+
+// NewWebPushWithConfig ...
+func NewWebPushWithConfig(config Config, log *slog.Logger) (wp *WebPush, err error) {
+	if config.ID == "" {
+		config.ID = "webpush"
+	}
 	wp = &WebPush{
-		vapidPrivateKey: vapidPvt,
-		vapidPublicKey:  vapidPub,
+		id:              config.ID,
+		vapidPrivateKey: config.VAPIDPrivateKey,
+		vapidPublicKey:  config.VAPIDPublicKey,
 		log:             log,
 	}
 	return
@@ -43,30 +65,37 @@ func (wp *WebPush) NewClient() (services.PumpClient, error) {
 
 // ID ...
 func (wp *WebPush) ID() string {
-	return "webpush"
+	return wp.id
 }
 
 // String ...
 func (wp *WebPush) String() string {
+	if wp.id != "webpush" {
+		return "WebPush (" + wp.id + ")"
+	}
 	return "WebPush"
 }
 
-func (wp *WebPush) SquashAndPushMessage(client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (wp *WebPush) SquashAndPushMessage(ctx context.Context, client services.PumpClient, smsgs []services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
 	panic("not implemented")
 }
 
-func (wp *WebPush) PushMessage(pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
+func (wp *WebPush) PushMessage(ctx context.Context, pclient services.PumpClient, smsg services.ServiceMessage, fc services.FeedbackCollector) services.PushStatus {
 	success := false
 	msg := smsg.(webPushMessage)
 	msg.options.HTTPClient = pclient.(*http.Client)
 	startedAt := time.Now()
 	// Send Notification
-	resp, err := wpg.SendNotification(msg.Payload, &msg.subscription, &msg.options)
+	ctx, span := services.StartSpan(ctx, wp, "WebPush send")
+	resp, err := wpg.SendNotificationWithContext(ctx, msg.Payload, &msg.subscription, &msg.options)
+	services.EndHTTPSpan(span, resp, err)
 	if err != nil {
 		wp.log.Error("Failed to send", "error", err)
+		services.ReportDetails(fc, err.Error())
 		return services.PushStatusHardFail
 	}
 	defer resp.Body.Close()
+	services.ReportDetails(fc, resp.Status)
 	duration := time.Now().Sub(startedAt)
 	wp.log.Info("Pushed", "status", resp.StatusCode, "duration", duration)
 	defer func() {
@@ -83,6 +112,9 @@ func (wp *WebPush) PushMessage(pclient services.PumpClient, smsg services.Servic
 		// reached a rate limit with a push service. The push service
 		// should include a 'Retry-After' header to indicate how long
 		// before another request can be made.
+		if delay, ok := services.ParseRetryAfter(resp.Header, time.Now()); ok {
+			services.ReportRetryAfter(fc, delay, "")
+		}
 		return services.PushStatusTempFail
 
 	case 400:
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrPumpStopped is returned when changing the workers of a pump that is no
+// longer serving.
+var ErrPumpStopped = errors.New("pump stopped")
+
+// Workers returns the number of workers of the pump.
+func (p *Pump) Workers() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.workers
+}
+
+// SetWorkers changes the number of workers. When serving, workers are started
+// or stopped right away. A worker that is stopped finishes the message it is
+// pushing first.
+func (p *Pump) SetWorkers(n int) (err error) {
+	if n < 1 {
+		return errors.New("at least one worker is required")
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.serving == nil {
+		p.workers = n
+		return
+	}
+	if p.serving.ctx.Err() != nil {
+		return ErrPumpStopped
+	}
+	err = p.scale(n)
+	p.workers = len(p.cancels)
+	if err == nil {
+		p.adapter.Logger().Info("Workers changed", "worker_count", n)
+	}
+	return
+}
+
+// scale starts or stops workers until n are running. The lock needs to be
+// held.
+func (p *Pump) scale(n int) error {
+	for len(p.cancels) < n {
+		client, err := p.adapter.NewClient()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(p.serving.ctx)
+		p.cancels = append(p.cancels, cancel)
+		p.wg.Add(1)
+		go p.serveClient(ctx, p.serving.q, client, p.serving.fc)
+	}
+	for len(p.cancels) > n {
+		last := len(p.cancels) - 1
+		p.cancels[last]()
+		p.cancels = p.cancels[:last]
+	}
+	return nil
+}
+
+// Pause stops the workers from taking messages from the queue, until resumed.
+// Messages keep being queued in the meantime.
+func (p *Pump) Pause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.paused {
+		p.paused = true
+		p.resumed = make(chan struct{})
+		p.adapter.Logger().Info("Paused")
+	}
+}
+
+// Resume undoes Pause.
+func (p *Pump) Resume() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.paused {
+		p.paused = false
+		close(p.resumed)
+		p.adapter.Logger().Info("Resumed")
+	}
+}
+
+// Paused tells whether or not the pump is paused.
+func (p *Pump) Paused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused
+}
+
+// waitResumed blocks while the pump is paused.
+func (p *Pump) waitResumed(ctx context.Context) error {
+	p.lock.Lock()
+	paused, resumed := p.paused, p.resumed
+	p.lock.Unlock()
+	if !paused {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
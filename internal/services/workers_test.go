@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"codeberg.org/pennersr/shove/internal/queue/memory"
+)
+
+func TestPauseAndScale(t *testing.T) {
+	pushed := make(chan string, 10)
+	adapter := countingAdapter(pushed)
+	p := NewPump(PumpConfig{Workers: 1}, adapter)
+	q, err := memory.MemoryQueueFactory{}.NewQueue("counting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- p.Serve(ctx, q, nopCollector{})
+	}()
+	if err = q.Queue([]byte(`{"token": "a"}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case token := <-pushed:
+		t.Fatal("pushed while paused", token)
+	case <-time.After(100 * time.Millisecond):
+	}
+	depth, err := q.Depth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth.Waiting != 1 {
+		t.Fatal(depth)
+	}
+	p.Resume()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not pushed after resuming")
+	}
+
+	if err = p.SetWorkers(3); err != nil {
+		t.Fatal(err)
+	}
+	if p.Workers() != 3 || adapter.clients != 3 {
+		t.Fatal(p.Workers(), adapter.clients)
+	}
+	if err = p.SetWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Queue([]byte(`{"token": "b"}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not pushed after scaling down")
+	}
+
+	cancel()
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pump did not stop")
+	}
+	if err = p.SetWorkers(2); err != ErrPumpStopped {
+		t.Fatal(err)
+	}
+}
+
+type squashCollector struct {
+	FeedbackCollector
+}
+
+func (squashCollector) CountSquash(serviceID string, pending int) {
+}
+
+func (squashCollector) CountSquashBatch(serviceID string, size int, pending int) {
+}
+
+func TestDrainFlushesSquasher(t *testing.T) {
+	pushed := make(chan string, 10)
+	adapter := countingAdapter(pushed)
+	p := NewPump(PumpConfig{
+		Workers: 1,
+		Squash:  SquashConfig{RateMax: 1, RatePer: time.Hour, Store: memory.NewSquashStore()},
+	}, adapter)
+	q, err := memory.MemoryQueueFactory{}.NewQueue("counting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{`{"token": "a"}`, `{"token": "a"}`, `{"token": "a"}`} {
+		if err = q.Queue([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go p.Serve(context.Background(), q, squashCollector{})
+	<-pushed
+	// Wait for the other two messages to be squashed.
+	for {
+		depth, _ := q.Depth()
+		if depth.Waiting == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = p.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed) != 2 {
+		t.Fatal(len(pushed))
+	}
+	depth, _ := q.Depth()
+	if depth.InFlight != 0 {
+		t.Fatal(depth)
+	}
+}
+
+func TestHandoverKeepsBatches(t *testing.T) {
+	pushed := make(chan string, 10)
+	adapter := countingAdapter(pushed)
+	config := PumpConfig{
+		Workers: 1,
+		Squash: SquashConfig{
+			RateMax: 1,
+			RatePer: time.Hour,
+			Store:   memory.NewSquashStore(),
+		},
+	}
+	p := NewPump(config, adapter)
+	q, err := memory.MemoryQueueFactory{}.NewQueue("counting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{`{"token": "a"}`, `{"token": "a"}`, `{"token": "a"}`} {
+		if err = q.Queue([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go p.Serve(context.Background(), q, squashCollector{})
+	<-pushed
+	for {
+		depth, _ := q.Depth()
+		if depth.Waiting == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = p.Handover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed) != 0 {
+		t.Fatal("flushed when handing over")
+	}
+	if pending, _ := config.Squash.Store.Pending(); pending != 1 {
+		t.Fatal(pending)
+	}
+
+	// The pump taking over sends the batch.
+	p = NewPump(config, adapter)
+	go p.Serve(context.Background(), q, squashCollector{})
+	for {
+		p.lock.Lock()
+		serving := p.serving != nil
+		p.lock.Unlock()
+		if serving {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = p.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed) != 2 {
+		t.Fatal(len(pushed))
+	}
+}
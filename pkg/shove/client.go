@@ -1,22 +1,53 @@
 package shove
 
 import (
+	"codeberg.org/pennersr/shove/internal/queue"
 	shvredis "codeberg.org/pennersr/shove/internal/queue/redis"
+	"codeberg.org/pennersr/shove/internal/services"
 	"github.com/gomodule/redigo/redis"
 	"time"
 )
 
+// DefaultIdempotencyWindow is a window of a day, matching a Shove server run
+// with -idempotency-window 86400, to opt in to deduplication using
+// NewRedisClientWithConfig.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// ErrDuplicate is returned when pushing a message carrying an `id` that was
+// already pushed within the idempotency window.
+var ErrDuplicate = queue.ErrDuplicate
+
 // Client ...
 type Client interface {
+	// PushRaw queues the raw message data. Delivery can be deferred by means
+	// of the `send_at` or `delay` envelope fields.
 	PushRaw(serviceID string, data []byte) (err error)
+	// PushRawBatch atomically queues several raw messages at once, using a
+	// single RPUSH for the messages that are due. If any of the messages is
+	// rejected (e.g. as a duplicate), none of them are queued.
+	PushRawBatch(serviceID string, data [][]byte) (err error)
+}
+
+// ClientConfig ...
+type ClientConfig struct {
+	// IdempotencyWindow is the period within which messages carrying the
+	// same `id` are considered duplicates. Zero disables deduplication.
+	IdempotencyWindow time.Duration
 }
 
 type redisClient struct {
-	pool *redis.Pool
+	pool   *redis.Pool
+	config ClientConfig
 }
 
-// NewRedisClient ...
+// NewRedisClient returns a client that does not deduplicate messages, see
+// NewRedisClientWithConfig.
 func NewRedisClient(redisURL string) Client {
+	return NewRedisClientWithConfig(redisURL, ClientConfig{})
+}
+
+// NewRedisClientWithConfig ...
+func NewRedisClientWithConfig(redisURL string, config ClientConfig) Client {
 	rc := &redisClient{
 		pool: &redis.Pool{
 			MaxIdle:     3,
@@ -25,15 +56,53 @@ func NewRedisClient(redisURL string) Client {
 				return redis.DialURL(redisURL)
 			},
 		},
+		config: config,
 	}
 	return rc
 }
 
 // PushRaw ...
 func (rc *redisClient) PushRaw(id string, data []byte) (err error) {
-	waitingList := shvredis.ListName(id)
+	return rc.PushRawBatch(id, [][]byte{data})
+}
+
+// PushRawBatch ...
+func (rc *redisClient) PushRawBatch(id string, data [][]byte) (err error) {
+	now := time.Now()
 	conn := rc.pool.Get()
 	defer conn.Close()
-	_, err = conn.Do("RPUSH", waitingList, data)
+	var claimed []string
+	defer func() {
+		if err != nil {
+			for _, key := range claimed {
+				shvredis.ReleaseIdempotencyKey(conn, id, key)
+			}
+		}
+	}()
+	msgs := make([][]byte, len(data))
+	due := make([]time.Time, len(data))
+	for i := range data {
+		var env services.Envelope
+		msgs[i], env, err = services.PrepareMessage(data[i], now)
+		if err != nil {
+			return
+		}
+		if env.ID != "" && rc.config.IdempotencyWindow > 0 {
+			var ok bool
+			ok, err = shvredis.ClaimIdempotencyKey(conn, id, env.ID, rc.config.IdempotencyWindow)
+			if err != nil {
+				return
+			}
+			if !ok {
+				err = ErrDuplicate
+				return
+			}
+			claimed = append(claimed, env.ID)
+		}
+		if !env.Due(now) {
+			due[i] = *env.SendAt
+		}
+	}
+	err = shvredis.QueueMessages(conn, id, msgs, due)
 	return
 }